@@ -2,9 +2,15 @@
 package blob
 
 import (
+  "context"
+  "errors"
   "fmt"
   "log"
-  "../storage"
+  "os"
+  "path/filepath"
+  "strings"
+  "time"
+  "../ignore"
   "../types"
 )
 
@@ -24,27 +30,66 @@ func check(err interface{}) {
 //   previous *Commit
 // }
 
-func GetBlob(hash types.Hash) types.Blob {
-  blob, err := storage.Configured().Get(hash)
-  if err == nil {
-    // log.Printf("Found %s in cache", GetShortHexString(hash))
-  } else {
-    responseChannel := make(chan types.Hash)
-    // XXX this should be more ... targetted
-    // XXX also, there's a race condition between looking on disk
-    // and subscribing to object reception.  I think.  Maybe not.
-    // Maybe we'll just make a duplicate network request.
-    // log.Printf("Requesting %s", GetShortHexString(hash))
-    types.BlobRequestChannel <- types.BlobRequest{Hash: hash, ResponseChannel: responseChannel}
-    // XXX what about failure?  timeout?
-    hash = <-responseChannel
-    // log.Printf("Received %s", GetShortHexString(hash))
-    blob, err = storage.Configured().Get(hash)
+var ErrBlobNotFound = errors.New("no peer has the object")
+
+// Returned by anything that gives up because the node is stopping
+var ErrStopped = errors.New("stopping")
+
+const maxFetchAttempts = 3
+const fetchRetryDelay = 250 * time.Millisecond
+
+// `fetch_timeout_ms` in shared.ini is how long to wait for peers to answer a
+// request for an object before asking again.
+func (env *Env) configuredFetchTimeout() time.Duration {
+  timeout, err := env.Config.GetInt("main", "fetch_timeout_ms")
+  if err != nil || timeout < 1 {
+    timeout = 10000
   }
-  if err != nil {
-    log.Fatal(err)
+  return time.Duration(timeout) * time.Millisecond
+}
+
+// GetBlob returns the object with the given hash, from the cache if it's
+// there and otherwise from whichever peer has it.  If every peer declines,
+// it asks again a couple of times, in case the object is still on its way
+// to them, before giving up with ErrBlobNotFound.
+func (env *Env) GetBlob(ctx context.Context, hash types.Hash) (types.Blob, error) {
+  blob, err := env.Storage.Get(hash)
+  if err == nil || !os.IsNotExist(err) {
+    return blob, err
+  }
+  timeout := env.configuredFetchTimeout()
+  for attempt := 0; attempt < maxFetchAttempts; attempt++ {
+    if attempt > 0 {
+      select {
+        case <-time.After(fetchRetryDelay << uint(attempt - 1)):
+        case <-ctx.Done():
+          return blob, ctx.Err()
+        case <-env.Hub.Done:
+          return blob, ErrStopped
+      }
+    }
+    // Buffered, so that the arbiter never waits on a request we gave up on
+    responseChannel := make(chan types.BlobResponse, 1)
+    // log.Printf("Requesting %s", GetShortHexString(hash))
+    select {
+      case env.Hub.BlobRequestChannel <- types.BlobRequest{Hash: hash, ResponseChannel: responseChannel}:
+      case <-env.Hub.Done:
+        return blob, ErrStopped
+    }
+    select {
+      case response := <-responseChannel:
+        if response.Found {
+          return env.Storage.Get(hash)
+        }
+      case <-time.After(timeout):
+        log.Printf("Timed out waiting for %s", GetShortHexString(hash))
+      case <-ctx.Done():
+        return blob, ctx.Err()
+      case <-env.Hub.Done:
+        return blob, ErrStopped
+    }
   }
-  return blob
+  return blob, ErrBlobNotFound
 }
 
 // func (blob *Blob) Hash() []byte {
@@ -99,10 +144,54 @@ func GetHexString(bytes []byte) string {
 //   return &Blob{bytes: bytes}
 // }
 
-func MakeEmptyTreeBlob(path string, revisionChannel chan types.Hash, mergeChannel chan types.Hash) *types.Tree {
+// Global ignore patterns are read from a comma-separated list in shared.ini,
+// e.g. `ignore = *.swp, .DS_Store, node_modules/`
+func (env *Env) configuredIgnorePatterns() []string {
+  patterns := []string{}
+  list, err := env.Config.GetString("main", "ignore")
+  if err != nil {
+    return patterns
+  }
+  for _, p := range strings.Split(list, ",") {
+    p = strings.TrimSpace(p)
+    if p != "" {
+      patterns = append(patterns, p)
+    }
+  }
+  return patterns
+}
+
+func (env *Env) MakeEmptyTreeBlob(share *Share, revisionChannel chan Revision, mergeChannel chan MergeRequest) *types.Tree {
   me := &types.Tree{}
-  resultChannel := make(chan FileUpdate, 10)
-  go MonitorTree(path, resultChannel, mergeChannel, revisionChannel)
-  go WatchTree(path, resultChannel)
+  resultChannel := make(chan FileUpdate, 100)
+  rules := ignore.New(env.configuredIgnorePatterns())
+  index := LoadIndex(filepath.Join(share.CachePath(env.CacheRoot), "index"), share.Root)
+  // Pick up where the last run left off
+  children := map[string]*types.TreeEntry{}
+  head, err := env.Storage.GetRef(share.RefName())
+  check(err)
+  if head != nil {
+    var commit *types.Commit
+    commit, err = env.getCommit(context.Background(), head)
+    if err == nil {
+      children, err = env.FlattenTree(context.Background(), commit.Tree)
+    }
+    if err != nil {
+      // Everything will look new, but nothing is lost
+      log.Printf("Unable to read the last commit for %s: %s", share.Name, err)
+      children = map[string]*types.TreeEntry{}
+    } else {
+      log.Printf("Starting %s from %s (%d entries)", share.Name, GetShortHexString(head), len(children))
+    }
+  }
+  for name := range children {
+    index.Track(name)
+  }
+  env.Hub.Go(func() { env.MonitorTree(share, rules, index, children, resultChannel, mergeChannel, revisionChannel) })
+  if share.scanned() {
+    env.Hub.Go(func() { env.ScanTree(share.Root, rules, index, resultChannel) })
+  } else {
+    env.Hub.Go(func() { env.WatchTree(share.Root, rules, index, resultChannel) })
+  }
   return me
 }
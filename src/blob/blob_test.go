@@ -0,0 +1,76 @@
+package blob
+
+import (
+  "context"
+  "testing"
+  "time"
+  conf "github.com/tillberg/goconfig"
+  "../types"
+)
+
+func TestGetBlobNotFound(t *testing.T) {
+  env := NewEnv(types.NewHub(), memStorage{}, "", conf.NewConfigFile())
+  defer close(env.Hub.Done)
+  // Every peer declines, every time
+  requests := make(chan types.BlobRequest, maxFetchAttempts + 1)
+  go func() {
+    for {
+      select {
+        case request := <-env.Hub.BlobRequestChannel:
+          requests <- request
+          request.ResponseChannel <- types.BlobResponse{Hash: request.Hash, Found: false}
+        case <-env.Hub.Done:
+          return
+      }
+    }
+  }()
+  _, err := env.GetBlob(context.Background(), types.Hash{1})
+  if err != ErrBlobNotFound {
+    t.Errorf("Expected ErrBlobNotFound, got %v", err)
+  }
+  if len(requests) != maxFetchAttempts {
+    t.Errorf("Expected %d requests, got %d", maxFetchAttempts, len(requests))
+  }
+}
+
+func TestGetBlobRetriesAfterTimeout(t *testing.T) {
+  config := conf.NewConfigFile()
+  config.AddOption("main", "fetch_timeout_ms", "50")
+  local := memStorage{}
+  env := NewEnv(types.NewHub(), local, "", config)
+  defer close(env.Hub.Done)
+  file := types.Blob{File: &types.File{Bytes: []byte("hello")}}
+  go func() {
+    // The first request goes unanswered
+    <-env.Hub.BlobRequestChannel
+    select {
+      case request := <-env.Hub.BlobRequestChannel:
+        local[GetHexString(request.Hash)] = file
+        request.ResponseChannel <- types.BlobResponse{Hash: request.Hash, Found: true}
+      case <-env.Hub.Done:
+    }
+  }()
+  // Full length, to be logged when the first request times out
+  hash := make(types.Hash, 20)
+  blob, err := env.GetBlob(context.Background(), hash)
+  if err != nil { t.Fatal(err) }
+  if blob.File == nil || string(blob.File.Bytes) != "hello" {
+    t.Errorf("Expected the file from the second request, got %v", blob)
+  }
+}
+
+func TestGetBlobCancellation(t *testing.T) {
+  // Nobody answers, so only cancelling or stopping ends the wait
+  env := NewEnv(types.NewHub(), memStorage{}, "", conf.NewConfigFile())
+  ctx, cancel := context.WithCancel(context.Background())
+  time.AfterFunc(50 * time.Millisecond, cancel)
+  _, err := env.GetBlob(ctx, types.Hash{1})
+  if err != context.Canceled {
+    t.Errorf("Expected the request to be cancelled, got %v", err)
+  }
+  time.AfterFunc(50 * time.Millisecond, func() { close(env.Hub.Done) })
+  _, err = env.GetBlob(context.Background(), types.Hash{1})
+  if err != ErrStopped {
+    t.Errorf("Expected the request to stop with the hub, got %v", err)
+  }
+}
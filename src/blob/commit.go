@@ -0,0 +1,94 @@
+package blob
+
+import (
+  "fmt"
+  "os"
+  "os/user"
+  "sort"
+  "strings"
+  "time"
+  "../types"
+)
+
+// The author of local commits is `name` and `email` in shared.ini.  Either
+// falls back to what the OS knows: the user's name, and user@hostname.
+func (env *Env) configuredIdentity() (string, string) {
+  name, nameErr := env.Config.GetString("main", "name")
+  email, emailErr := env.Config.GetString("main", "email")
+  username := "unknown"
+  osUser, err := user.Current()
+  if err == nil {
+    username = osUser.Username
+  }
+  if nameErr != nil || name == "" {
+    name = username
+    if err == nil && osUser.Name != "" {
+      name = osUser.Name
+    }
+  }
+  if emailErr != nil || email == "" {
+    hostname, err := os.Hostname()
+    if err != nil {
+      hostname = "localhost"
+    }
+    email = fmt.Sprintf("%s@%s", username, hostname)
+  }
+  return name, email
+}
+
+// Formats an author or committer line the way git does, with the local
+// timezone offset.
+func formatSignature(name string, email string, when time.Time) string {
+  return fmt.Sprintf("%s <%s> %d %s", name, email, when.Unix(), when.Format("-0700"))
+}
+
+func commitText(name string, email string, when time.Time, message string) string {
+  signature := formatSignature(name, email, when)
+  return fmt.Sprintf("author %s\ncommitter %s\n\n%s", signature, signature, message)
+}
+
+// Describes the difference between two flattened trees as a commit message,
+// with a one-line summary followed by the paths that were added, modified
+// and removed.
+func describeChanges(before map[string]*types.TreeEntry, after map[string]*types.TreeEntry) string {
+  added, modified, removed := []string{}, []string{}, []string{}
+  for name, entry := range after {
+    if before[name] == nil {
+      added = append(added, name)
+    } else if !sameEntry(before[name], entry) {
+      modified = append(modified, name)
+    }
+  }
+  for name := range before {
+    if after[name] == nil {
+      removed = append(removed, name)
+    }
+  }
+  sort.Strings(added)
+  sort.Strings(modified)
+  sort.Strings(removed)
+  total := len(added) + len(modified) + len(removed)
+  var summary string
+  switch {
+    case total == 0:
+      summary = "No changes"
+    case total > 1:
+      summary = fmt.Sprintf("Update %d files", total)
+    case len(added) == 1:
+      summary = "Add " + added[0]
+    case len(modified) == 1:
+      summary = "Update " + modified[0]
+    default:
+      summary = "Remove " + removed[0]
+  }
+  sections := []string{summary}
+  for _, section := range []struct {
+    title string
+    paths []string
+  }{{"Added", added}, {"Modified", modified}, {"Removed", removed}} {
+    if len(section.paths) > 0 {
+      sections = append(sections, section.title + ":\n\t" + strings.Join(section.paths, "\n\t"))
+    }
+  }
+  return strings.Join(sections, "\n\n") + "\n"
+}
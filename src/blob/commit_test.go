@@ -0,0 +1,31 @@
+package blob
+
+import (
+  "testing"
+  "time"
+  "../types"
+)
+
+func TestFormatSignature(t *testing.T) {
+  when := time.Date(2013, 2, 16, 12, 59, 0, 0, time.FixedZone("PST", -8 * 3600))
+  actual := formatSignature("Alice", "alice@example.com", when)
+  expected := "Alice <alice@example.com> 1361048340 -0800"
+  if actual != expected {
+    t.Errorf("Expected %q, got %q", expected, actual)
+  }
+}
+
+func TestDescribeChanges(t *testing.T) {
+  before := map[string]*types.TreeEntry{"kept": entry(1), "edited": entry(1), "gone": entry(1)}
+  after := map[string]*types.TreeEntry{"kept": entry(1), "edited": entry(2), "new/a": entry(3), "new/b": entry(3)}
+  expected := "Update 4 files\n\nAdded:\n\tnew/a\n\tnew/b\n\nModified:\n\tedited\n\nRemoved:\n\tgone\n"
+  actual := describeChanges(before, after)
+  if actual != expected {
+    t.Errorf("Expected %q, got %q", expected, actual)
+  }
+  actual = describeChanges(map[string]*types.TreeEntry{}, map[string]*types.TreeEntry{"notes.txt": entry(1)})
+  expected = "Add notes.txt\n\nAdded:\n\tnotes.txt\n"
+  if actual != expected {
+    t.Errorf("Expected %q, got %q", expected, actual)
+  }
+}
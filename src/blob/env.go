@@ -0,0 +1,44 @@
+package blob
+
+import (
+  "sync"
+  conf "github.com/tillberg/goconfig"
+  "../storage"
+  "../types"
+)
+
+// An Env is what a node's shares have in common: where objects are stored,
+// the hub connecting them to the node's arbiters and peers, and the
+// configuration the node was started with.
+type Env struct {
+  Hub       *types.Hub
+  Storage   storage.Storage
+  CacheRoot string
+  Config    *conf.ConfigFile
+  // Changed files on their way to be settled, read and hashed
+  processChannel chan FileEvent
+  // Changed files settled and waiting for a worker, and the workers' queues
+  settled        chan FileEvent
+  workers        []chan FileEvent
+  // Paths the debouncer is holding back, and files being read, updated
+  // atomically
+  settling       int32
+  processing     int32
+  shallowMutex   sync.Mutex
+  // Commits whose parents were never fetched, loaded on first use
+  shallow        map[string]bool
+  ownWritesMutex sync.Mutex
+  // Files just unpacked into the shares, by path
+  ownWrites      map[string]ownWrite
+}
+
+func NewEnv(hub *types.Hub, store storage.Storage, cacheRoot string, config *conf.ConfigFile) *Env {
+  return &Env{
+    Hub: hub,
+    Storage: store,
+    CacheRoot: cacheRoot,
+    Config: config,
+    processChannel: make(chan FileEvent, 100),
+    ownWrites: map[string]ownWrite{},
+  }
+}
@@ -0,0 +1,70 @@
+package blob
+
+import (
+  "log"
+  "os"
+  "time"
+  "../types"
+)
+
+// Objects younger than this are never collected, since they may belong to
+// a revision still on its way to being committed or merged.
+const gcGracePeriod = time.Hour
+
+// CollectGarbage removes every object that no ref leads to, through commits'
+// parents and trees' entries, unless it was stored within the grace period.
+// It returns how many were removed.  History missing from the cache (past a
+// shallow boundary, say) is skipped over rather than fetched.
+func (env *Env) CollectGarbage() (int, error) {
+  return env.collectGarbage(gcGracePeriod)
+}
+
+func (env *Env) collectGarbage(grace time.Duration) (int, error) {
+  refs, err := env.Storage.ListRefs()
+  if err != nil { return 0, err }
+  reachable := map[string]bool{}
+  stack := []types.Hash{}
+  for _, hash := range refs {
+    stack = append(stack, hash)
+  }
+  for len(stack) > 0 {
+    hash := stack[len(stack) - 1]
+    stack = stack[:len(stack) - 1]
+    key := GetHexString(hash)
+    if reachable[key] { continue }
+    reachable[key] = true
+    blob, err := env.Storage.Get(hash)
+    if os.IsNotExist(err) { continue }
+    if err != nil { return 0, err }
+    if blob.Commit != nil {
+      stack = append(stack, blob.Commit.Tree)
+      stack = append(stack, blob.Commit.Parents...)
+    } else if blob.Tree != nil {
+      for _, entry := range blob.Tree.Entries {
+        if entry.Flags == modeTree {
+          stack = append(stack, entry.Hash)
+        } else {
+          // Files refer to nothing, so there's no need to read them
+          reachable[GetHexString(entry.Hash)] = true
+        }
+      }
+    }
+  }
+  cutoff := time.Now().Add(-grace)
+  garbage := []types.Hash{}
+  err = env.Storage.ListObjects(func(hash types.Hash, stored time.Time) error {
+    if !reachable[GetHexString(hash)] && stored.Before(cutoff) {
+      garbage = append(garbage, hash)
+    }
+    return nil
+  })
+  if err != nil { return 0, err }
+  for _, hash := range garbage {
+    err = env.Storage.Remove(hash)
+    if err != nil { return 0, err }
+  }
+  if len(garbage) > 0 {
+    log.Printf("Collected %d unreachable objects", len(garbage))
+  }
+  return len(garbage), nil
+}
@@ -0,0 +1,65 @@
+package blob
+
+import (
+  "encoding/hex"
+  "strings"
+  "testing"
+  "time"
+  "../types"
+)
+
+// memStorage with refs, and objects stored at a given time
+type gcStorage struct {
+  memStorage
+  refs   map[string]types.Hash
+  stored map[string]time.Time
+}
+
+func (store gcStorage) GetRef(name string) (types.Hash, error) { return store.refs[name], nil }
+func (store gcStorage) ListRefs() (map[string]types.Hash, error) { return store.refs, nil }
+func (store gcStorage) ListObjects(visit func(hash types.Hash, stored time.Time) error) error {
+  for key := range store.memStorage {
+    hash, _ := hex.DecodeString(strings.TrimPrefix(key, "0x"))
+    err := visit(hash, store.stored[key])
+    if err != nil { return err }
+  }
+  return nil
+}
+
+func TestCollectGarbage(t *testing.T) {
+  old := time.Now().Add(-24 * time.Hour)
+  store := gcStorage{memStorage: memStorage{}, refs: map[string]types.Hash{}, stored: map[string]time.Time{}}
+  add := func(hash byte, blob types.Blob, stored time.Time) {
+    store.memStorage[GetHexString(types.Hash{hash})] = blob
+    store.stored[GetHexString(types.Hash{hash})] = stored
+  }
+  // 2 -> tree 3 -> file 4 and tree 5 -> file 6, with its parent 1 missing
+  // from the cache
+  add(2, types.Blob{Commit: &types.Commit{Tree: types.Hash{3}, Parents: []types.Hash{{1}}}}, old)
+  add(3, types.Blob{Tree: &types.Tree{Entries: []*types.TreeEntry{
+    {Hash: types.Hash{4}, Name: "file", Flags: modeFile},
+    {Hash: types.Hash{5}, Name: "dir", Flags: modeTree},
+  }}}, old)
+  add(4, types.Blob{File: &types.File{}}, old)
+  add(5, types.Blob{Tree: &types.Tree{Entries: []*types.TreeEntry{{Hash: types.Hash{6}, Name: "file", Flags: modeFile}}}}, old)
+  add(6, types.Blob{File: &types.File{}}, old)
+  // Dropped by thinning: 7 -> tree 8 -> file 9
+  add(7, types.Blob{Commit: &types.Commit{Tree: types.Hash{8}, Parents: []types.Hash{}}}, old)
+  add(8, types.Blob{Tree: &types.Tree{Entries: []*types.TreeEntry{{Hash: types.Hash{9}, Name: "file", Flags: modeFile}}}}, old)
+  add(9, types.Blob{File: &types.File{}}, old)
+  // Unreachable, but only just stored
+  add(10, types.Blob{File: &types.File{}}, time.Now())
+  store.refs["master"] = types.Hash{2}
+  env := &Env{Storage: store}
+  removed, err := env.collectGarbage(time.Hour)
+  if err != nil { t.Fatal(err) }
+  if removed != 3 {
+    t.Errorf("Expected 3 objects to be collected, got %d", removed)
+  }
+  for hash := byte(2); hash <= 10; hash++ {
+    expected := hash < 7 || hash > 9
+    if store.Has(types.Hash{hash}) != expected {
+      t.Errorf("Expected object %d to be kept: %v", hash, expected)
+    }
+  }
+}
@@ -0,0 +1,363 @@
+package blob
+
+import (
+  "bufio"
+  "bytes"
+  "container/heap"
+  "context"
+  "encoding/hex"
+  "fmt"
+  "io/ioutil"
+  "log"
+  "os"
+  "path"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "sync"
+  "../types"
+)
+
+// The commit graph remembers the parents of every commit it has seen, along
+// with its generation number: one more than the greatest of its parents', or
+// 1 for a root.  A commit can only descend from commits of a lower
+// generation, which keeps ancestry walks from wandering off into history
+// that can't matter.  It lives in the cache directory as one line per
+// commit, each after its parents:
+//
+//   <hash> <generation> <parent hash>...
+//
+// and is only ever appended to.
+const commitGraphHeader = "shared-commit-graph 1"
+
+type graphNode struct {
+  generation uint32
+  parents    []types.Hash
+}
+
+type CommitGraph struct {
+  mutex    sync.Mutex
+  filePath string
+  nodes    map[string]*graphNode
+  // Looks up the parents of a commit not yet in the graph
+  readParents func(ctx context.Context, hash types.Hash) ([]types.Hash, error)
+}
+
+// Shallow boundaries count as roots, since their parents were never fetched
+func (env *Env) readCommitParents(ctx context.Context, hash types.Hash) ([]types.Hash, error) {
+  if env.IsShallow(hash) {
+    return []types.Hash{}, nil
+  }
+  commit, err := env.getCommit(ctx, hash)
+  if err != nil { return nil, err }
+  return commit.Parents, nil
+}
+
+// LoadCommitGraph reads the commit graph kept in the cache.  A missing or
+// damaged graph is rebuilt from the commits themselves as needed.
+func (env *Env) LoadCommitGraph() *CommitGraph {
+  return loadCommitGraph(filepath.Join(env.CacheRoot, "commit-graph"), env.readCommitParents)
+}
+
+func loadCommitGraph(filePath string,
+                     readParents func(ctx context.Context, hash types.Hash) ([]types.Hash, error)) *CommitGraph {
+  graph := &CommitGraph{filePath: filePath, nodes: map[string]*graphNode{}, readParents: readParents}
+  data, err := ioutil.ReadFile(filePath)
+  if err != nil {
+    if !os.IsNotExist(err) {
+      log.Printf("Error reading commit graph %s: %s", filePath, err)
+    }
+    return graph
+  }
+  lines := strings.Split(string(data), "\n")
+  if lines[0] != commitGraphHeader {
+    log.Printf("Ignoring commit graph %s with unrecognized header", filePath)
+    return graph
+  }
+  for _, line := range lines[1:] {
+    if line == "" { continue }
+    fields := strings.Split(line, " ")
+    hash, err := hex.DecodeString(fields[0])
+    valid := err == nil && len(fields) >= 2
+    node := &graphNode{parents: []types.Hash{}}
+    if valid {
+      generation, err := strconv.ParseUint(fields[1], 10, 32)
+      node.generation = uint32(generation)
+      valid = err == nil
+      for _, field := range fields[2:] {
+        parent, err := hex.DecodeString(field)
+        // Parents always come first
+        valid = valid && err == nil && graph.nodes[GetHexString(parent)] != nil
+        node.parents = append(node.parents, parent)
+      }
+    }
+    if !valid {
+      // Probably cut short by a crash.  Start over rather than append to
+      // something that can't be read back.
+      log.Printf("Discarding commit graph %s at malformed line: %s", filePath, line)
+      os.Remove(filePath)
+      graph.nodes = map[string]*graphNode{}
+      break
+    }
+    graph.nodes[GetHexString(hash)] = node
+  }
+  return graph
+}
+
+// Appends newly added commits to the file
+func (graph *CommitGraph) save(added []types.Hash) {
+  if len(added) == 0 || graph.filePath == "" { return }
+  err := os.MkdirAll(path.Dir(graph.filePath), 0755)
+  _, statErr := os.Stat(graph.filePath)
+  var file *os.File
+  if err == nil {
+    file, err = os.OpenFile(graph.filePath, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0644)
+  }
+  if err != nil {
+    log.Printf("Error saving commit graph: %s", err)
+    return
+  }
+  defer file.Close()
+  writer := bufio.NewWriter(file)
+  if os.IsNotExist(statErr) {
+    fmt.Fprintln(writer, commitGraphHeader)
+  }
+  for _, hash := range added {
+    node := graph.nodes[GetHexString(hash)]
+    fmt.Fprintf(writer, "%s %d", hex.EncodeToString(hash), node.generation)
+    for _, parent := range node.parents {
+      fmt.Fprintf(writer, " %s", hex.EncodeToString(parent))
+    }
+    fmt.Fprintln(writer)
+  }
+  err = writer.Flush()
+  if err != nil {
+    log.Printf("Error saving commit graph: %s", err)
+  }
+}
+
+// Returns the node for a commit, first adding it and whichever of its
+// ancestors are missing from the graph.  Whatever was added is saved even if
+// some ancestor couldn't be read.
+func (graph *CommitGraph) node(ctx context.Context, hash types.Hash) (*graphNode, error) {
+  if node := graph.nodes[GetHexString(hash)]; node != nil {
+    return node, nil
+  }
+  added := []types.Hash{}
+  defer func() { graph.save(added) }()
+  parentsOf := map[string][]types.Hash{}
+  stack := []types.Hash{hash}
+  for len(stack) > 0 {
+    next := stack[len(stack) - 1]
+    key := GetHexString(next)
+    if graph.nodes[key] != nil {
+      stack = stack[:len(stack) - 1]
+      continue
+    }
+    parents, present := parentsOf[key]
+    if !present {
+      var err error
+      parents, err = graph.readParents(ctx, next)
+      if err != nil { return nil, err }
+      parentsOf[key] = parents
+    }
+    node := &graphNode{generation: 1, parents: parents}
+    ready := true
+    for _, parent := range parents {
+      parentNode := graph.nodes[GetHexString(parent)]
+      if parentNode == nil {
+        ready = false
+        stack = append(stack, parent)
+      } else if parentNode.generation >= node.generation {
+        node.generation = parentNode.generation + 1
+      }
+    }
+    if ready {
+      graph.nodes[key] = node
+      added = append(added, next)
+      stack = stack[:len(stack) - 1]
+    }
+  }
+  return graph.nodes[GetHexString(hash)], nil
+}
+
+// Descends reports whether a is b or has b among its ancestors.  Only
+// commits of a greater generation than b are walked past.
+func (graph *CommitGraph) Descends(ctx context.Context, a types.Hash, b types.Hash) (bool, error) {
+  graph.mutex.Lock()
+  defer graph.mutex.Unlock()
+  if bytes.Equal(a, b) { return true, nil }
+  _, err := graph.node(ctx, b)
+  if err != nil { return false, err }
+  _, err = graph.node(ctx, a)
+  if err != nil { return false, err }
+  return graph.descends(a, b), nil
+}
+
+// Commits waiting to be walked, greatest generation first, so that a commit
+// is only reached once everything above it has been
+type generationQueue struct {
+  graph  *CommitGraph
+  hashes []types.Hash
+}
+
+func (queue *generationQueue) Len() int { return len(queue.hashes) }
+func (queue *generationQueue) Swap(i, j int) {
+  queue.hashes[i], queue.hashes[j] = queue.hashes[j], queue.hashes[i]
+}
+func (queue *generationQueue) Less(i, j int) bool {
+  a := queue.graph.nodes[GetHexString(queue.hashes[i])].generation
+  b := queue.graph.nodes[GetHexString(queue.hashes[j])].generation
+  if a != b { return a > b }
+  return bytes.Compare(queue.hashes[i], queue.hashes[j]) > 0
+}
+func (queue *generationQueue) Push(x interface{}) { queue.hashes = append(queue.hashes, x.(types.Hash)) }
+func (queue *generationQueue) Pop() interface{} {
+  last := queue.hashes[len(queue.hashes) - 1]
+  queue.hashes = queue.hashes[:len(queue.hashes) - 1]
+  return last
+}
+
+const (
+  paintedA = 1 << iota
+  paintedB
+  paintedStale
+)
+
+// Walks down from a and b together, marking each commit with which of them
+// it is reachable from.  visit sees each commit once, with its final marks,
+// and returns the marks to pass on to its parents.  The walk ends once
+// every commit left to visit has all of the marks in doneWith.
+func (graph *CommitGraph) paint(a types.Hash, b types.Hash, doneWith int,
+                                visit func(hash types.Hash, marks int) int) {
+  marks := map[string]int{GetHexString(a): paintedA}
+  marks[GetHexString(b)] |= paintedB
+  queue := &generationQueue{graph: graph}
+  heap.Push(queue, a)
+  if !bytes.Equal(a, b) { heap.Push(queue, b) }
+  visited := map[string]bool{}
+  for queue.Len() > 0 {
+    done := true
+    for _, hash := range queue.hashes {
+      if marks[GetHexString(hash)] & doneWith != doneWith {
+        done = false
+        break
+      }
+    }
+    if done { return }
+    next := heap.Pop(queue).(types.Hash)
+    key := GetHexString(next)
+    if visited[key] { continue }
+    visited[key] = true
+    passOn := visit(next, marks[key])
+    for _, parent := range graph.nodes[key].parents {
+      parentKey := GetHexString(parent)
+      if marks[parentKey] & passOn != passOn {
+        marks[parentKey] |= passOn
+        heap.Push(queue, parent)
+      }
+    }
+  }
+}
+
+// The same as Descends, for callers already holding the lock
+func (graph *CommitGraph) descends(a types.Hash, b types.Hash) bool {
+  if bytes.Equal(a, b) { return true }
+  generationB := graph.nodes[GetHexString(b)].generation
+  visited := map[string]bool{}
+  queue := []types.Hash{a}
+  for len(queue) > 0 {
+    next := queue[0]
+    queue = queue[1:]
+    if bytes.Equal(next, b) { return true }
+    key := GetHexString(next)
+    if visited[key] { continue }
+    visited[key] = true
+    node := graph.nodes[key]
+    if node.generation <= generationB {
+      // Nothing from here on can be b
+      continue
+    }
+    queue = append(queue, node.parents...)
+  }
+  return false
+}
+
+// MergeBase finds the best common ancestor of two commits, or nil if their
+// histories are unrelated.  Where there are several (after criss-cross
+// merges), the one of greatest generation, then greatest hash, is chosen so
+// that every peer chooses the same one.
+func (graph *CommitGraph) MergeBase(ctx context.Context, a types.Hash, b types.Hash) (types.Hash, error) {
+  graph.mutex.Lock()
+  defer graph.mutex.Unlock()
+  for _, hash := range []types.Hash{a, b} {
+    _, err := graph.node(ctx, hash)
+    if err != nil { return nil, err }
+  }
+  candidates := []types.Hash{}
+  graph.paint(a, b, paintedStale, func(hash types.Hash, marks int) int {
+    if marks & (paintedA | paintedB | paintedStale) == paintedA | paintedB {
+      // Everything beneath a common ancestor is common, too, and no better
+      candidates = append(candidates, hash)
+      return marks | paintedStale
+    }
+    return marks
+  })
+  var best types.Hash
+  for _, candidate := range candidates {
+    redundant := false
+    for _, other := range candidates {
+      if !bytes.Equal(candidate, other) && graph.descends(other, candidate) {
+        redundant = true
+        break
+      }
+    }
+    if redundant { continue }
+    if best == nil {
+      best = candidate
+      continue
+    }
+    candidateGeneration := graph.nodes[GetHexString(candidate)].generation
+    bestGeneration := graph.nodes[GetHexString(best)].generation
+    if candidateGeneration > bestGeneration ||
+       (candidateGeneration == bestGeneration && bytes.Compare(candidate, best) > 0) {
+      best = candidate
+    }
+  }
+  return best, nil
+}
+
+// CommitsBetween lists the commits reachable from b but not from a (what git
+// calls a..b), newest first.
+func (graph *CommitGraph) CommitsBetween(ctx context.Context, a types.Hash, b types.Hash) ([]types.Hash, error) {
+  graph.mutex.Lock()
+  defer graph.mutex.Unlock()
+  return graph.commitsBetween(ctx, a, b)
+}
+
+func (graph *CommitGraph) commitsBetween(ctx context.Context, a types.Hash, b types.Hash) ([]types.Hash, error) {
+  for _, hash := range []types.Hash{a, b} {
+    _, err := graph.node(ctx, hash)
+    if err != nil { return nil, err }
+  }
+  commits := []types.Hash{}
+  graph.paint(a, b, paintedA, func(hash types.Hash, marks int) int {
+    if marks & paintedA == 0 {
+      commits = append(commits, hash)
+    }
+    return marks
+  })
+  return commits, nil
+}
+
+// AheadBehind counts the commits in local that remote doesn't have, and
+// those in remote that local doesn't have.
+func (graph *CommitGraph) AheadBehind(ctx context.Context, local types.Hash, remote types.Hash) (int, int, error) {
+  graph.mutex.Lock()
+  defer graph.mutex.Unlock()
+  ahead, err := graph.commitsBetween(ctx, remote, local)
+  if err != nil { return 0, 0, err }
+  behind, err := graph.commitsBetween(ctx, local, remote)
+  if err != nil { return 0, 0, err }
+  return len(ahead), len(behind), nil
+}
@@ -0,0 +1,101 @@
+package blob
+
+import (
+  "bytes"
+  "context"
+  "errors"
+  "io/ioutil"
+  "os"
+  "path"
+  "testing"
+  "../types"
+)
+
+// A history of single-byte commit hashes, by parents:
+//
+//   1 <- 2 <- 3 <- 5
+//    \        /
+//     <- 4 <-
+//   6 (unrelated)
+var testHistory = map[byte][]byte{1: {}, 2: {1}, 3: {2}, 4: {1}, 5: {3, 4}, 6: {}}
+
+func readTestParents(ctx context.Context, hash types.Hash) ([]types.Hash, error) {
+  parents, present := testHistory[hash[0]]
+  if !present { return nil, errors.New("no such commit") }
+  hashes := []types.Hash{}
+  for _, parent := range parents {
+    hashes = append(hashes, types.Hash{parent})
+  }
+  return hashes, nil
+}
+
+func testGraph(filePath string) *CommitGraph {
+  return loadCommitGraph(filePath, readTestParents)
+}
+
+func TestCommitGraphDescends(t *testing.T) {
+  dir, err := ioutil.TempDir("", "graph")
+  if err != nil { t.Fatal(err) }
+  defer os.RemoveAll(dir)
+  filePath := path.Join(dir, "commit-graph")
+  graph := testGraph(filePath)
+  cases := []struct {
+    a, b     byte
+    descends bool
+  }{{5, 1, true}, {5, 4, true}, {3, 4, false}, {4, 2, false}, {1, 5, false}, {2, 2, true}, {5, 6, false}}
+  for _, c := range cases {
+    descends, err := graph.Descends(context.Background(), types.Hash{c.a}, types.Hash{c.b})
+    if err != nil { t.Fatal(err) }
+    if descends != c.descends {
+      t.Errorf("Expected Descends(%d, %d) to be %v", c.a, c.b, c.descends)
+    }
+  }
+  if graph.nodes[GetHexString(types.Hash{5})].generation != 4 {
+    t.Errorf("Expected generation 4, got %d", graph.nodes[GetHexString(types.Hash{5})].generation)
+  }
+  // Everything seen so far is read back without looking at any commits
+  reloaded := loadCommitGraph(filePath, nil)
+  descends, err := reloaded.Descends(context.Background(), types.Hash{5}, types.Hash{4})
+  if err != nil || !descends {
+    t.Errorf("Expected the reloaded graph to know that 5 descends from 4")
+  }
+  _, err = graph.Descends(context.Background(), types.Hash{7}, types.Hash{1})
+  if err == nil {
+    t.Errorf("Expected an error for an unknown commit")
+  }
+}
+
+func TestCommitGraphMergeBase(t *testing.T) {
+  graph := testGraph("")
+  cases := []struct {
+    a, b byte
+    base types.Hash
+  }{{3, 4, types.Hash{1}}, {5, 3, types.Hash{3}}, {2, 2, types.Hash{2}}, {5, 6, nil}}
+  for _, c := range cases {
+    base, err := graph.MergeBase(context.Background(), types.Hash{c.a}, types.Hash{c.b})
+    if err != nil { t.Fatal(err) }
+    if !bytes.Equal(base, c.base) {
+      t.Errorf("Expected MergeBase(%d, %d) to be %v, got %v", c.a, c.b, c.base, base)
+    }
+  }
+}
+
+func TestCommitGraphCommitsBetween(t *testing.T) {
+  graph := testGraph("")
+  commits, err := graph.CommitsBetween(context.Background(), types.Hash{4}, types.Hash{5})
+  if err != nil { t.Fatal(err) }
+  expected := []types.Hash{{5}, {3}, {2}}
+  if len(commits) != len(expected) {
+    t.Fatalf("Expected %v, got %v", expected, commits)
+  }
+  for i := range expected {
+    if !bytes.Equal(commits[i], expected[i]) {
+      t.Fatalf("Expected %v, got %v", expected, commits)
+    }
+  }
+  ahead, behind, err := graph.AheadBehind(context.Background(), types.Hash{3}, types.Hash{4})
+  if err != nil { t.Fatal(err) }
+  if ahead != 2 || behind != 1 {
+    t.Errorf("Expected 2 ahead and 1 behind, got %d and %d", ahead, behind)
+  }
+}
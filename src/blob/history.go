@@ -0,0 +1,111 @@
+package blob
+
+import (
+  "context"
+  "fmt"
+  "regexp"
+  "strconv"
+  "time"
+  "../types"
+)
+
+func (env *Env) getCommit(ctx context.Context, hash types.Hash) (*types.Commit, error) {
+  commitBlob, err := env.GetBlob(ctx, hash)
+  if err != nil { return nil, err }
+  if commitBlob.Commit == nil {
+    return nil, fmt.Errorf("expected commit %s but got %v instead", GetShortHexString(hash), commitBlob)
+  }
+  return commitBlob.Commit, nil
+}
+
+var regexpAuthor = regexp.MustCompile(`(?m)^author (.*?) <[^>]*> (\d+) [+-]\d{4}$`)
+
+// Returns the author name and timestamp recorded in a commit.
+func commitAuthor(commit *types.Commit) (string, time.Time) {
+  submatch := regexpAuthor.FindStringSubmatch(commit.Text)
+  if submatch == nil {
+    return "unknown", time.Unix(0, 0)
+  }
+  seconds, _ := strconv.ParseInt(submatch[2], 10, 64)
+  return submatch[1], time.Unix(seconds, 0)
+}
+
+// Reports false if the node stops before the arbiter answers.
+func (env *Env) DoesADescendFromB(a types.Hash, b types.Hash) bool {
+  query := types.BranchAncestryQuery{CommitA: a, CommitB: b, ResponseChannel: make(chan bool, 1)}
+  select {
+    case env.Hub.DoesADescendFromBChannel <- query:
+    case <-env.Hub.Done:
+      return false
+  }
+  select {
+    case descends := <-query.ResponseChannel:
+      return descends
+    case <-env.Hub.Done:
+      return false
+  }
+}
+
+// MergeBase finds the best common ancestor of two commits, or nil if their
+// histories are unrelated.
+func (env *Env) MergeBase(ctx context.Context, a types.Hash, b types.Hash) (types.Hash, error) {
+  // Buffered, so that the arbiter never waits on a query we gave up on
+  query := types.MergeBaseQuery{CommitA: a, CommitB: b, ResponseChannel: make(chan types.MergeBaseResponse, 1)}
+  select {
+    case env.Hub.MergeBaseChannel <- query:
+    case <-ctx.Done():
+      return nil, ctx.Err()
+    case <-env.Hub.Done:
+      return nil, ErrStopped
+  }
+  select {
+    case response := <-query.ResponseChannel:
+      return response.Base, response.Err
+    case <-ctx.Done():
+      return nil, ctx.Err()
+    case <-env.Hub.Done:
+      return nil, ErrStopped
+  }
+}
+
+// AheadBehind counts the commits in local that remote doesn't have, and
+// those in remote that local doesn't have.
+func (env *Env) AheadBehind(ctx context.Context, local types.Hash, remote types.Hash) (int, int, error) {
+  query := types.AheadBehindQuery{Local: local, Remote: remote, ResponseChannel: make(chan types.AheadBehindResponse, 1)}
+  select {
+    case env.Hub.AheadBehindChannel <- query:
+    case <-ctx.Done():
+      return 0, 0, ctx.Err()
+    case <-env.Hub.Done:
+      return 0, 0, ErrStopped
+  }
+  select {
+    case response := <-query.ResponseChannel:
+      return response.Ahead, response.Behind, response.Err
+    case <-ctx.Done():
+      return 0, 0, ctx.Err()
+    case <-env.Hub.Done:
+      return 0, 0, ErrStopped
+  }
+}
+
+// CommitsBetween lists the commits reachable from b but not from a, newest
+// first.
+func (env *Env) CommitsBetween(ctx context.Context, a types.Hash, b types.Hash) ([]types.Hash, error) {
+  query := types.CommitsBetweenQuery{CommitA: a, CommitB: b, ResponseChannel: make(chan types.CommitsBetweenResponse, 1)}
+  select {
+    case env.Hub.CommitsBetweenChannel <- query:
+    case <-ctx.Done():
+      return nil, ctx.Err()
+    case <-env.Hub.Done:
+      return nil, ErrStopped
+  }
+  select {
+    case response := <-query.ResponseChannel:
+      return response.Commits, response.Err
+    case <-ctx.Done():
+      return nil, ctx.Err()
+    case <-env.Hub.Done:
+      return nil, ErrStopped
+  }
+}
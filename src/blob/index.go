@@ -0,0 +1,194 @@
+package blob
+
+import (
+  "bufio"
+  "encoding/hex"
+  "fmt"
+  "io/ioutil"
+  "log"
+  "os"
+  "path"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "sync"
+  "syscall"
+  "time"
+  "../types"
+)
+
+// The index remembers the stat info of every file as of when it was last
+// hashed, so that unchanged files can be trusted without being read again.
+// It lives in the cache directory as one line per file:
+//
+//   <hash> <flags> <size> <mtime ns> <inode> <quoted path>
+//
+// preceded by a header recording when it was written.
+const indexHeader = "shared-index 1"
+
+type indexEntry struct {
+  Hash    types.Hash
+  Flags   uint32
+  Size    int64
+  ModTime int64
+  Inode   uint64
+}
+
+type Index struct {
+  mutex    sync.Mutex
+  filePath string
+  rootPath string
+  savedAt  int64
+  entries  map[string]*indexEntry // keyed by path relative to rootPath
+}
+
+func inode(statbuf os.FileInfo) uint64 {
+  stat, ok := statbuf.Sys().(*syscall.Stat_t)
+  if !ok { return 0 }
+  return uint64(stat.Ino)
+}
+
+// LoadIndex reads the index at filePath, for the share at rootPath.  A
+// missing or unreadable index just means that everything gets hashed.
+func LoadIndex(filePath string, rootPath string) *Index {
+  idx := &Index{filePath: filePath, rootPath: rootPath, entries: map[string]*indexEntry{}}
+  data, err := ioutil.ReadFile(filePath)
+  if err != nil {
+    if !os.IsNotExist(err) {
+      log.Printf("Error reading index %s: %s", filePath, err)
+    }
+    return idx
+  }
+  lines := strings.Split(string(data), "\n")
+  if !strings.HasPrefix(lines[0], indexHeader + " ") {
+    log.Printf("Ignoring index %s with unrecognized header", filePath)
+    return idx
+  }
+  idx.savedAt, _ = strconv.ParseInt(strings.TrimPrefix(lines[0], indexHeader + " "), 10, 64)
+  for _, line := range lines[1:] {
+    if line == "" { continue }
+    fields := strings.SplitN(line, " ", 6)
+    if len(fields) != 6 {
+      log.Printf("Skipping malformed index line: %s", line)
+      continue
+    }
+    entry := &indexEntry{}
+    hash, err1 := hex.DecodeString(fields[0])
+    flags, err2 := strconv.ParseUint(fields[1], 8, 32)
+    size, err3 := strconv.ParseInt(fields[2], 10, 64)
+    modTime, err4 := strconv.ParseInt(fields[3], 10, 64)
+    ino, err5 := strconv.ParseUint(fields[4], 10, 64)
+    relPath, err6 := strconv.Unquote(fields[5])
+    if err1 != nil || err2 != nil || err3 != nil || err4 != nil || err5 != nil || err6 != nil {
+      log.Printf("Skipping malformed index line: %s", line)
+      continue
+    }
+    entry.Hash, entry.Flags, entry.Size, entry.ModTime, entry.Inode = hash, uint32(flags), size, modTime, ino
+    idx.entries[relPath] = entry
+  }
+  return idx
+}
+
+func (idx *Index) relPath(filePath string) string {
+  rel, err := filepath.Rel(idx.rootPath, filePath)
+  check(err)
+  return rel
+}
+
+// Lookup returns the hash recorded for a file if its stat info hasn't
+// changed since.  Files modified no earlier than the index was last saved
+// could have changed again within the same mtime tick, so they aren't
+// trusted (git calls this the "racy" case).
+func (idx *Index) Lookup(filePath string, statbuf os.FileInfo) (types.Hash, bool) {
+  idx.mutex.Lock()
+  defer idx.mutex.Unlock()
+  entry := idx.entries[idx.relPath(filePath)]
+  if entry == nil || entry.Hash == nil {
+    return nil, false
+  }
+  modTime := statbuf.ModTime().UnixNano()
+  if entry.Size != statbuf.Size() || entry.ModTime != modTime || entry.Inode != inode(statbuf) ||
+     entry.Flags != entryFlags(statbuf) || modTime >= idx.savedAt {
+    return nil, false
+  }
+  return entry.Hash, true
+}
+
+func (idx *Index) Update(filePath string, statbuf os.FileInfo, hash types.Hash) {
+  idx.mutex.Lock()
+  defer idx.mutex.Unlock()
+  idx.entries[idx.relPath(filePath)] = &indexEntry{
+    Hash: hash,
+    Flags: entryFlags(statbuf),
+    Size: statbuf.Size(),
+    ModTime: statbuf.ModTime().UnixNano(),
+    Inode: inode(statbuf),
+  }
+}
+
+// Track makes sure that relPath is listed, so that WatchTree will notice if
+// it has gone missing, without vouching for its contents.
+func (idx *Index) Track(relPath string) {
+  idx.mutex.Lock()
+  defer idx.mutex.Unlock()
+  if idx.entries[relPath] == nil {
+    idx.entries[relPath] = &indexEntry{}
+  }
+}
+
+// Remove forgets a path along with, if it was a directory, everything
+// beneath it.
+func (idx *Index) Remove(filePath string) {
+  idx.mutex.Lock()
+  defer idx.mutex.Unlock()
+  rel := idx.relPath(filePath)
+  for name := range idx.entries {
+    if name == rel || strings.HasPrefix(name, rel + "/") {
+      delete(idx.entries, name)
+    }
+  }
+}
+
+// Forget drops a single path, leaving anything beneath it listed.
+func (idx *Index) Forget(filePath string) {
+  idx.mutex.Lock()
+  defer idx.mutex.Unlock()
+  delete(idx.entries, idx.relPath(filePath))
+}
+
+// Paths returns every listed path, relative to the root of the share.
+func (idx *Index) Paths() []string {
+  idx.mutex.Lock()
+  defer idx.mutex.Unlock()
+  paths := []string{}
+  for name := range idx.entries {
+    paths = append(paths, name)
+  }
+  return paths
+}
+
+func (idx *Index) Save() error {
+  idx.mutex.Lock()
+  defer idx.mutex.Unlock()
+  savedAt := time.Now().UnixNano()
+  err := os.MkdirAll(path.Dir(idx.filePath), 0755)
+  if err != nil { return err }
+  tempFile, err := ioutil.TempFile(path.Dir(idx.filePath), path.Base(idx.filePath))
+  if err != nil { return err }
+  writer := bufio.NewWriter(tempFile)
+  fmt.Fprintf(writer, "%s %d\n", indexHeader, savedAt)
+  for name, entry := range idx.entries {
+    fmt.Fprintf(writer, "%s %o %d %d %d %s\n", hex.EncodeToString(entry.Hash), entry.Flags,
+                entry.Size, entry.ModTime, entry.Inode, strconv.Quote(name))
+  }
+  err = writer.Flush()
+  closeErr := tempFile.Close()
+  if err == nil { err = closeErr }
+  if err == nil { err = os.Rename(tempFile.Name(), idx.filePath) }
+  if err != nil {
+    os.Remove(tempFile.Name())
+    return err
+  }
+  idx.savedAt = savedAt
+  return nil
+}
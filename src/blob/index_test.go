@@ -0,0 +1,52 @@
+package blob
+
+import (
+  "io/ioutil"
+  "os"
+  "path"
+  "testing"
+  "time"
+  "../types"
+)
+
+func TestIndex(t *testing.T) {
+  root, err := ioutil.TempDir("", "shared-index")
+  if err != nil { t.Fatal(err) }
+  defer os.RemoveAll(root)
+  filePath := path.Join(root, "a b", "file")
+  os.MkdirAll(path.Dir(filePath), 0755)
+  ioutil.WriteFile(filePath, []byte("hello"), 0644)
+  statbuf, _ := os.Lstat(filePath)
+  indexPath := path.Join(root, "cache", "shared-index")
+  index := LoadIndex(indexPath, root)
+  index.Update(filePath, statbuf, types.Hash{1, 2, 3})
+  index.Track("gone")
+  err = index.Save()
+  if err != nil { t.Fatal(err) }
+
+  index = LoadIndex(indexPath, root)
+  hash, ok := index.Lookup(filePath, statbuf)
+  if !ok || len(hash) != 3 || hash[2] != 3 {
+    t.Fatalf("Expected the index to vouch for an unchanged file, got %v", hash)
+  }
+  if len(index.Paths()) != 2 {
+    t.Errorf("Expected 2 paths in the index, got %v", index.Paths())
+  }
+  _, ok = index.Lookup(path.Join(root, "gone"), statbuf)
+  if ok {
+    t.Errorf("Tracked paths should never be trusted")
+  }
+
+  time.Sleep(10 * time.Millisecond)
+  ioutil.WriteFile(filePath, []byte("hello to you"), 0644)
+  statbuf, _ = os.Lstat(filePath)
+  _, ok = index.Lookup(filePath, statbuf)
+  if ok {
+    t.Errorf("The index should not vouch for a modified file")
+  }
+
+  index.Remove(path.Join(root, "a b"))
+  if len(index.Paths()) != 1 {
+    t.Errorf("Removing a directory should remove everything beneath it, left %v", index.Paths())
+  }
+}
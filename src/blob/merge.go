@@ -0,0 +1,110 @@
+package blob
+
+import (
+  "bytes"
+  "fmt"
+  "log"
+  "path"
+  "strings"
+  "time"
+  "../types"
+)
+
+func sameEntry(a *types.TreeEntry, b *types.TreeEntry) bool {
+  if a == nil || b == nil {
+    return a == nil && b == nil
+  }
+  return bytes.Equal(a.Hash, b.Hash) && a.Flags == b.Flags
+}
+
+// Who is responsible for one side of a merge, and as of when.  Conflict
+// copies are named after the side that lost, using the author and date of
+// its commit so that every peer names the copy the same way.
+type mergeSide struct {
+  peer string
+  when time.Time
+}
+
+// Builds e.g. "notes (conflict from alice 2013-02-16 20-59-00).txt"
+func conflictPath(name string, side mergeSide) string {
+  dir, base := path.Split(name)
+  ext := path.Ext(base)
+  if ext == base {
+    // A dotfile such as .bashrc has no extension to speak of
+    ext = ""
+  }
+  stem := strings.TrimSuffix(base, ext)
+  date := side.when.UTC().Format("2006-01-02 15-04-05")
+  return fmt.Sprintf("%s%s (conflict from %s %s)%s", dir, stem, side.peer, date, ext)
+}
+
+// Every directory that some path in a flattened tree is beneath
+func treeDirs(tree map[string]*types.TreeEntry) map[string]bool {
+  dirs := map[string]bool{}
+  for name := range tree {
+    for dir := path.Dir(name); dir != "." && !dirs[dir]; dir = path.Dir(dir) {
+      dirs[dir] = true
+    }
+  }
+  return dirs
+}
+
+// mergeTrees does a three-way merge of flattened trees, path by path.  A
+// path changed on only one side takes that side's version.  When both sides
+// changed a path differently, an edit beats a removal.  If both edited it,
+// the version with the greater hash (or mode) stays put, so that every peer
+// resolves the conflict the same way, and the other version is kept
+// alongside it as a conflict copy.  A file on one side where the other has
+// a directory moves aside to a conflict copy, leaving the directory be.
+func mergeTrees(base map[string]*types.TreeEntry, ours map[string]*types.TreeEntry,
+                theirs map[string]*types.TreeEntry, oursSide mergeSide,
+                theirsSide mergeSide) (map[string]*types.TreeEntry, []types.Conflict) {
+  merged := map[string]*types.TreeEntry{}
+  conflicts := []types.Conflict{}
+  paths := map[string]bool{}
+  for name := range ours { paths[name] = true }
+  for name := range theirs { paths[name] = true }
+  for name := range paths {
+    b, o, t := base[name], ours[name], theirs[name]
+    if sameEntry(o, t) || sameEntry(b, t) {
+      if o != nil { merged[name] = o }
+    } else if sameEntry(b, o) {
+      if t != nil { merged[name] = t }
+    } else if o == nil {
+      merged[name] = t
+    } else if t == nil {
+      merged[name] = o
+    } else {
+      winner, loser, loserSide := o, t, theirsSide
+      if bytes.Compare(o.Hash, t.Hash) < 0 || (bytes.Equal(o.Hash, t.Hash) && o.Flags < t.Flags) {
+        winner, loser, loserSide = t, o, oursSide
+      }
+      copyPath := conflictPath(name, loserSide)
+      log.Printf("Conflict in %s, keeping the other version as %s", name, copyPath)
+      merged[name] = winner
+      merged[copyPath] = &types.TreeEntry{Hash: loser.Hash, Name: path.Base(copyPath), Flags: loser.Flags}
+      conflicts = append(conflicts, types.Conflict{Path: name, CopyPath: copyPath, Peer: loserSide.peer})
+    }
+  }
+  mergedDirs, theirsDirs := treeDirs(merged), treeDirs(theirs)
+  clashes := []string{}
+  for name := range merged {
+    if mergedDirs[name] {
+      clashes = append(clashes, name)
+    }
+  }
+  for _, name := range clashes {
+    file := merged[name]
+    // The directory came from whichever side the file didn't
+    fileSide := theirsSide
+    if theirsDirs[name] {
+      fileSide = oursSide
+    }
+    copyPath := conflictPath(name, fileSide)
+    log.Printf("Conflict in %s, which is a directory on one side; keeping the file as %s", name, copyPath)
+    delete(merged, name)
+    merged[copyPath] = &types.TreeEntry{Hash: file.Hash, Name: path.Base(copyPath), Flags: file.Flags}
+    conflicts = append(conflicts, types.Conflict{Path: name, CopyPath: copyPath, Peer: fileSide.peer})
+  }
+  return merged, conflicts
+}
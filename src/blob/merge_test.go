@@ -0,0 +1,101 @@
+package blob
+
+import (
+  "testing"
+  "time"
+  "../types"
+)
+
+func entry(hash byte) *types.TreeEntry {
+  return &types.TreeEntry{Hash: types.Hash{hash}, Flags: modeFile}
+}
+
+func TestMergeTrees(t *testing.T) {
+  base := map[string]*types.TreeEntry{
+    "unchanged": entry(1),
+    "ours": entry(1),
+    "theirs": entry(1),
+    "both-same": entry(1),
+    "conflict": entry(1),
+    "removed-by-us": entry(1),
+    "removed-by-them": entry(1),
+    "edit-vs-remove": entry(1),
+  }
+  ours := map[string]*types.TreeEntry{
+    "unchanged": entry(1),
+    "ours": entry(2),
+    "theirs": entry(1),
+    "both-same": entry(2),
+    "conflict": entry(2),
+    "removed-by-them": entry(1),
+    "edit-vs-remove": entry(2),
+    "added-by-us": entry(2),
+    "file-vs-dir": entry(2),
+  }
+  theirs := map[string]*types.TreeEntry{
+    "unchanged": entry(1),
+    "ours": entry(1),
+    "theirs": entry(3),
+    "both-same": entry(2),
+    "conflict": entry(3),
+    "removed-by-us": entry(1),
+    "added-by-them": entry(3),
+    "file-vs-dir/inner": entry(3),
+  }
+  expected := map[string]*types.TreeEntry{
+    "unchanged": entry(1),
+    "ours": entry(2),
+    "theirs": entry(3),
+    "both-same": entry(2),
+    "conflict": entry(3),
+    "conflict (conflict from alice 2013-02-16 20-59-00)": entry(2),
+    "edit-vs-remove": entry(2),
+    "added-by-us": entry(2),
+    "added-by-them": entry(3),
+    "file-vs-dir/inner": entry(3),
+    "file-vs-dir (conflict from alice 2013-02-16 20-59-00)": entry(2),
+  }
+  alice := mergeSide{peer: "alice", when: time.Unix(1361048340, 0)}
+  bob := mergeSide{peer: "bob", when: time.Unix(1361048400, 0)}
+  merged, conflicts := mergeTrees(base, ours, theirs, alice, bob)
+  if len(merged) != len(expected) {
+    t.Errorf("Expected %d entries, got %d", len(expected), len(merged))
+  }
+  for name, e := range expected {
+    if !sameEntry(merged[name], e) {
+      t.Errorf("%s: expected %v, got %v", name, e, merged[name])
+    }
+  }
+  if len(conflicts) != 2 {
+    t.Errorf("Expected two conflicts, got %v", conflicts)
+  }
+  for _, conflict := range conflicts {
+    if (conflict.Path != "conflict" && conflict.Path != "file-vs-dir") || conflict.Peer != "alice" {
+      t.Errorf("Unexpected conflict %v", conflict)
+    }
+  }
+  // Conflicts resolve the same way from either side
+  reversed, _ := mergeTrees(base, theirs, ours, bob, alice)
+  if len(reversed) != len(merged) {
+    t.Errorf("Conflict resolved differently from the other side")
+  }
+  for name, e := range merged {
+    if !sameEntry(reversed[name], e) {
+      t.Errorf("Conflict resolved differently from the other side: %s", name)
+    }
+  }
+}
+
+func TestConflictPath(t *testing.T) {
+  side := mergeSide{peer: "alice", when: time.Unix(1361048340, 0)}
+  cases := map[string]string{
+    "notes.txt": "notes (conflict from alice 2013-02-16 20-59-00).txt",
+    "a/b/Makefile": "a/b/Makefile (conflict from alice 2013-02-16 20-59-00)",
+    ".bashrc": ".bashrc (conflict from alice 2013-02-16 20-59-00)",
+  }
+  for name, expected := range cases {
+    if conflictPath(name, side) != expected {
+      t.Errorf("Expected %s, got %s", expected, conflictPath(name, side))
+    }
+  }
+}
@@ -3,205 +3,968 @@ package blob
 
 import (
   "bytes"
+  "context"
+  "errors"
   "fmt"
+  "hash/fnv"
   "io/ioutil"
   "log"
   "os"
-  "os/exec"
   "path"
+  "path/filepath"
+  "runtime"
+  "strings"
+  "sync/atomic"
+  "syscall"
   "time"
   "github.com/howeyc/fsnotify"
-  "../storage"
+  "../ignore"
   "../types"
 )
 
-var processChannel = make(chan FileEvent, 100) // debouncing
+// A tree to be committed to the branch.  Trees that result from merging in
+// a remote commit carry that commit along, to be recorded as a parent.
+type Revision struct {
+  Tree      types.Hash
+  Merge     types.Hash
+  Conflicts []types.Conflict
+}
+
+// A remote commit to merge into the working tree, along with the common
+// ancestor to merge against (nil if the histories are unrelated) and the
+// local head at the time (nil if nothing has been committed yet).
+type MergeRequest struct {
+  Commit types.Hash
+  Base   types.Hash
+  Head   types.Hash
+}
 
-func MonitorTree(rootPath string, fileUpdateChannel chan FileUpdate,
-                 mergeChannel chan types.Hash, revisionChannel chan types.Hash) {
+// children starts out as the last committed tree, if there is one, so that
+// a restart with nothing changed on disk produces no new revision.
+func (env *Env) MonitorTree(share *Share, rules *ignore.Rules, index *Index,
+                 children map[string]*types.TreeEntry, fileUpdateChannel chan FileUpdate,
+                 mergeChannel chan MergeRequest, revisionChannel chan Revision) {
   // XXX ideally, this would be a B-Tree with distributed caching
-  var children = map[string]*types.TreeEntry{}
+  rootPath := share.Root
+  saveIndex := func() {
+    err := index.Save()
+    if err != nil {
+      log.Printf("Error saving index: %s", err)
+    }
+  }
   updateSelf := func() {
-    tree := &types.Tree{Entries: []*types.TreeEntry{}}
-    for name, treeEntry := range children {
-      tree.Entries = append(tree.Entries, &types.TreeEntry{
-        Hash: treeEntry.Hash,
-        Flags: uint32(0100644),
-        Name: name,
-      })
-    }
-    hash, err := storage.Configured().Put(types.Blob{Tree: tree})
+    hash, err := env.PutTree(children)
+    if err != nil {
+      // children still has the changes, so the next update carries them
+      log.Printf("Unable to store the tree of %s: %s", share.RefName(), err)
+      return
+    }
+    saveIndex()
+    select {
+      case revisionChannel <- Revision{Tree: hash}:
+      case <-env.Hub.Done:
+    }
+  }
+  // WatchTree reloads the rules as soon as it sees an ignore file change, so
+  // by the time the file itself arrives here the rules are current.
+  // Anything tracked that is now ignored gets dropped from the tree.
+  // An ignore file that changes also changes the tree, so updateSelf will
+  // follow from the update to the ignore file itself.
+  untrackIgnored := func() {
+    for name := range children {
+      if rules.Ignored(name, false) {
+        log.Printf("Ignoring %s", name)
+        delete(children, name)
+      }
+    }
+  }
+  // Applies a single update to children, reporting whether anything changed
+  applyUpdate := func(fileUpdate FileUpdate) bool {
+    filename, err := filepath.Rel(rootPath, fileUpdate.Path)
     check(err)
-    revisionChannel <- hash
+    if path.Base(filename) == ignore.FileName {
+      untrackIgnored()
+    }
+    if fileUpdate.Exists && fileUpdate.Flags == modeTree {
+      // Now a directory, so any file tracked under its name is gone, but
+      // not what's beneath it
+      if children[filename] == nil {
+        return false
+      }
+      log.Printf("Removed %s, which is now a directory", filename)
+      delete(children, filename)
+      index.Forget(fileUpdate.Path)
+      return true
+    }
+    if fileUpdate.Exists && rules.Ignored(filename, false) {
+      // Queued before the rules that ignore it were loaded, or ignored
+      // since it was last committed
+      if children[filename] == nil {
+        return false
+      }
+      log.Printf("Ignoring %s", filename)
+      delete(children, filename)
+      index.Remove(fileUpdate.Path)
+      return true
+    }
+    if !fileUpdate.Exists {
+      index.Remove(fileUpdate.Path)
+      // The path may have been a directory, in which case everything
+      // beneath it is gone as well.
+      removed := false
+      for name := range children {
+        if name == filename || strings.HasPrefix(name, filename + "/") {
+          log.Printf("Removed %s", name)
+          delete(children, name)
+          removed = true
+        }
+      }
+      return removed
+    }
+    if fileUpdate.Flags == modeSymlink &&
+       !isLinkInsideRoot(rootPath, fileUpdate.Path, string(fileUpdate.Bytes)) {
+      log.Printf("Refusing to sync symlink %s -> %s, which points outside the share",
+                 filename, fileUpdate.Bytes)
+      if children[filename] == nil {
+        return false
+      }
+      delete(children, filename)
+      return true
+    }
+    hash := fileUpdate.Hash
+    index.Update(fileUpdate.Path, fileUpdate.Info, hash)
+    existing := children[filename]
+    if existing != nil && bytes.Equal(hash, existing.Hash) && existing.Flags == fileUpdate.Flags {
+      return false
+    }
+    op := "Added"
+    if existing != nil { op = "Updated" }
+    log.Printf("%s %s (%d bytes, %o) %s", op, filename, fileUpdate.Size, fileUpdate.Flags, GetShortHexString(hash))
+    children[filename] = &types.TreeEntry{Hash: hash, Name: path.Base(filename), Flags: fileUpdate.Flags}
+    return true
+  }
+  // Merges a remote commit into children.  Everything in it is fetched
+  // before the working directory is touched, so a merge that can't be
+  // completed leaves things as they were.
+  merge := func(mergeRequest MergeRequest) error {
+    ctx := context.Background()
+    err := env.Prefetch(ctx, mergeRequest.Commit)
+    if err != nil { return err }
+    theirsCommit, err := env.getCommit(ctx, mergeRequest.Commit)
+    if err != nil { return err }
+    theirs, err := env.FlattenTree(ctx, theirsCommit.Tree)
+    if err != nil { return err }
+    base := map[string]*types.TreeEntry{}
+    if mergeRequest.Base != nil {
+      baseCommit, err := env.getCommit(ctx, mergeRequest.Base)
+      if err != nil { return err }
+      base, err = env.FlattenTree(ctx, baseCommit.Tree)
+      if err != nil { return err }
+    }
+    theirsSide := mergeSide{}
+    theirsSide.peer, theirsSide.when = commitAuthor(theirsCommit)
+    oursSide := mergeSide{when: time.Now()}
+    if mergeRequest.Head != nil {
+      headCommit, err := env.getCommit(ctx, mergeRequest.Head)
+      if err != nil { return err }
+      oursSide.peer, oursSide.when = commitAuthor(headCommit)
+    } else {
+      oursSide.peer, _ = os.Hostname()
+    }
+    log.Printf("Merging %s into tree (%d entries)", GetShortHexString(mergeRequest.Commit), len(theirs))
+    merged, conflicts := mergeTrees(base, children, theirs, oursSide, theirsSide)
+    conflicts = append(conflicts, env.unpackTreeDiff(ctx, share, rules, index, children, merged)...)
+    children = merged
+    hash, err := env.PutTree(children)
+    if err != nil { return err }
+    saveIndex()
+    select {
+      case revisionChannel <- Revision{Tree: hash, Merge: mergeRequest.Commit, Conflicts: conflicts}:
+      case <-env.Hub.Done:
+    }
+    return nil
   }
   for {
     select {
       case fileUpdate := <- fileUpdateChannel:
-        filename := path.Base(fileUpdate.Path)
-        if !fileUpdate.Exists {
-          if children[filename] != nil {
-            log.Printf("Removed %s", filename)
-            delete(children, filename)
-            updateSelf()
-          }
-        } else {
-          blob := types.Blob{File: &types.File{Bytes: fileUpdate.Bytes}}
-          hash, err := storage.Configured().Put(blob)
-          check(err)
-          if children[filename] == nil || !bytes.Equal(hash, children[filename].Hash) {
-            op := "Added"
-            if children[filename] != nil { op = "Updated" }
-            log.Printf("%s %s (%d bytes) %s", op, filename, fileUpdate.Size, GetShortHexString(hash))
-            children[filename] = &types.TreeEntry{Hash: hash}
-            updateSelf()
+        // Apply everything that's ready before building a new tree, so that
+        // a burst of changes makes for as few revisions as possible
+        changed := applyUpdate(fileUpdate)
+        for pending := true; pending; {
+          select {
+            case fileUpdate = <-fileUpdateChannel:
+              changed = applyUpdate(fileUpdate) || changed
+            default:
+              pending = false
           }
         }
-      case mergeHash := <-mergeChannel:
-        // This is not a merge but a destructive fast-forward
-        commitBlob := GetBlob(mergeHash)
-        if commitBlob.Commit == nil {
-          log.Fatalf("Tried to merge commit %s but got %v instead", GetShortHexString(mergeHash), commitBlob)
+        if changed {
+          updateSelf()
         }
-        treeBlob := GetBlob(commitBlob.Commit.Tree)
-        tree := treeBlob.Tree
-        log.Printf("Merging %s into tree (%d entries)", GetShortHexString(mergeHash), len(tree.Entries))
-        children = map[string]*types.TreeEntry{}
-        for _, entry := range tree.Entries {
-          children[entry.Name] = entry
-          fileblob := GetBlob(entry.Hash)
-          file := fileblob.File
-          ioutil.WriteFile(path.Join(rootPath, entry.Name), file.Bytes, 0644)
-          log.Printf("Unpacked %s, %s", entry.Name, GetShortHexString(entry.Hash))
+      case mergeRequest := <-mergeChannel:
+        // Local changes not yet committed are already in children, so they
+        // take part in the merge as "ours".
+        err := merge(mergeRequest)
+        if err != nil {
+          // The next remote revision will try again
+          log.Printf("Unable to merge %s: %s", GetShortHexString(mergeRequest.Commit), err)
         }
+      case <-env.Hub.Done:
+        return
     }
   }
 }
 
 type FileUpdate struct {
-  Bytes  []byte
+  Bytes  []byte // the target of the link, for symlinks
+  Hash   types.Hash
   Path   string
   Exists bool
   Size   int64
+  Flags  uint32 // modeTree if the path is now a directory
+  Info   os.FileInfo
 }
 
 
 type FileEvent struct {
   path          string
   resultChannel chan FileUpdate
+  index         *Index
+  attempts      int
 }
 
-func processChange(inputChannel chan FileEvent) {
+const maxReadAttempts = 5
+
+// Hands an event to the debouncer, unless the node is stopping
+func (env *Env) queue(event FileEvent) {
+  select {
+    case env.processChannel <- event:
+    case <-env.Hub.Done:
+  }
+}
+
+// Sends an event back through the debouncer after a failed read
+func (env *Env) retry(event FileEvent, err error) {
+  event.attempts++
+  if event.attempts >= maxReadAttempts {
+    log.Printf("Giving up on %s after %d attempts: %s", event.path, event.attempts, err)
+    return
+  }
+  // Not from this goroutine, which the debouncer may be waiting on
+  env.Hub.Go(func() { env.queue(event) })
+}
+
+func (env *Env) processChange(inputChannel chan FileEvent) {
   for event := range inputChannel {
-    statbuf, err := os.Stat(event.path)
-    if err != nil {
-      // The file was deleted or otherwise doesn't exist
-      event.resultChannel <- FileUpdate{Path: event.path, Exists: false}
-    } else {
-      // Read the entire file and calculate its hash
-      // XXX alternate path for large files?
-      bytes, err := ioutil.ReadFile(event.path)
-      check(err)
-      // Send the update back to the tree's result channel
-      event.resultChannel <- FileUpdate{Bytes: bytes, Path: event.path, Exists: true, Size: statbuf.Size()}
+    atomic.AddInt32(&env.processing, 1)
+    env.processEvent(event)
+    atomic.AddInt32(&env.processing, -1)
+  }
+}
+
+// Reads, hashes and stores a changed file, and sends what was found to the
+// file's tree
+func (env *Env) processEvent(event FileEvent) {
+  statbuf, err := os.Lstat(event.path)
+  if err != nil {
+    // The file was deleted or otherwise doesn't exist
+    env.forgetOwnWrite(event.path)
+    select {
+      case event.resultChannel <- FileUpdate{Path: event.path, Exists: false}:
+      case <-env.Hub.Done:
+        return
+    }
+  } else if statbuf.IsDir() {
+    // Directories are tracked by WatchTree and their files arrive
+    // separately, but a file that stood here before is gone
+    env.forgetOwnWrite(event.path)
+    select {
+      case event.resultChannel <- FileUpdate{Path: event.path, Exists: true, Flags: modeTree}:
+      case <-env.Hub.Done:
+    }
+  } else {
+    expected := env.expectedOwnWrite(event.path, statbuf)
+    hash, indexed := event.index.Lookup(event.path, statbuf)
+    flags := entryFlags(statbuf)
+    var data []byte
+    // A file that looks like one we just unpacked is read regardless of
+    // the index, which can't tell a same-size rewrite apart either
+    if !indexed || expected != nil {
+      if flags == modeSymlink {
+        // Symlinks are stored as a blob holding the link target, like git
+        var target string
+        target, err = os.Readlink(event.path)
+        data = []byte(target)
+      } else {
+        // Read the entire file and calculate its hash
+        // XXX alternate path for large files?
+        data, err = ioutil.ReadFile(event.path)
+      }
+      if err == nil {
+        after, statErr := os.Lstat(event.path)
+        if statErr != nil || after.Size() != statbuf.Size() || !after.ModTime().Equal(statbuf.ModTime()) {
+          err = errors.New("changed while being read")
+        }
+      }
+      if err != nil {
+        // Most likely it was deleted or replaced out from under us; the
+        // retry will find out which
+        env.retry(event, err)
+        return
+      }
+      hash, err = env.Storage.Put(types.Blob{File: &types.File{Bytes: data}})
+      if err != nil {
+        env.retry(event, err)
+        return
+      }
+    }
+    if expected != nil {
+      if bytes.Equal(expected, hash) {
+        // Just unpacked from a remote revision; MonitorTree already has it
+        return
+      }
+      env.forgetOwnWrite(event.path)
+    }
+    if flags != modeSymlink {
+      // MonitorTree only needs the contents of symlinks, to vet them
+      data = nil
+    }
+    // Send the update back to the tree's result channel
+    update := FileUpdate{
+      Bytes: data,
+      Hash: hash,
+      Path: event.path,
+      Exists: true,
+      Size: statbuf.Size(),
+      Flags: flags,
+      Info: statbuf,
     }
+    select {
+      case event.resultChannel <- update:
+      case <-env.Hub.Done:
+        return
+    }
+  }
+}
+
+// What a path looked like the last time the debouncer checked on it
+type settleState struct {
+  event      FileEvent
+  firstEvent time.Time
+  lastEvent  time.Time
+  exists     bool
+  size       int64
+  modTime    time.Time
+}
+
+// Re-stats the path, reporting whether anything changed since last time
+func (state *settleState) restat() bool {
+  statbuf, err := os.Lstat(state.event.path)
+  exists := err == nil
+  var size int64
+  var modTime time.Time
+  if exists {
+    size, modTime = statbuf.Size(), statbuf.ModTime()
   }
+  changed := exists != state.exists || size != state.size || !modTime.Equal(state.modTime)
+  state.exists, state.size, state.modTime = exists, size, modTime
+  return changed
 }
 
-func debounce(output chan FileEvent, input chan FileEvent) {
-  var waiting = map[string] bool {}
-  var timeout_channel = make(chan FileEvent, 100)
+// `settle_ms` in shared.ini is how long a file must go without events or
+// changes to its size and mtime before it is read; `settle_max_ms` caps how
+// long a file that never settles (a growing log, say) can be put off.
+func (env *Env) configuredSettleTimes() (time.Duration, time.Duration) {
+  quiet, err := env.Config.GetInt("main", "settle_ms")
+  if err != nil || quiet < 1 {
+    quiet = 20
+  }
+  maxWait, err := env.Config.GetInt("main", "settle_max_ms")
+  if err != nil || maxWait < quiet {
+    maxWait = 2000
+  }
+  return time.Duration(quiet) * time.Millisecond, time.Duration(maxWait) * time.Millisecond
+}
+
+// Holds each path back until it has settled.  Since deletes settle just like
+// writes, an editor that saves by writing a temporary file and renaming it
+// over the original produces one update for the original once the dust
+// clears, and the temporary file is gone by the time anyone looks for it.
+// Once done is closed, so is output.  If settling is set, it's kept up to
+// date with the number of paths being held back.
+func debounce(output chan FileEvent, input chan FileEvent, done <-chan struct{},
+              quiet time.Duration, maxWait time.Duration, settling *int32) {
+  var pending = map[string]*settleState{}
+  counted := func() {
+    if settling != nil {
+      atomic.StoreInt32(settling, int32(len(pending)))
+    }
+  }
+  var checkChannel = make(chan string, 100)
+  schedule := func(filePath string, delay time.Duration) {
+    time.AfterFunc(delay, func() {
+      select {
+        case checkChannel <- filePath:
+        case <-done:
+      }
+    })
+  }
   for {
     select {
       case in := <-input:
-        if !waiting[in.path] {
-          waiting[in.path] = true
-          go func(_in FileEvent) {
-              time.Sleep(5 * time.Millisecond)
-              timeout_channel <- _in
-          }(in)
+        now := time.Now()
+        state := pending[in.path]
+        if state == nil {
+          state = &settleState{firstEvent: now}
+          pending[in.path] = state
+          counted()
+          schedule(in.path, quiet)
+        }
+        state.event = in
+        state.lastEvent = now
+        state.restat()
+      case filePath := <-checkChannel:
+        state := pending[filePath]
+        if state == nil { continue }
+        changed := state.restat()
+        quietFor := time.Since(state.lastEvent)
+        if (!changed && quietFor >= quiet) || time.Since(state.firstEvent) >= maxWait {
+          delete(pending, filePath)
+          counted()
+          select {
+            case output <- state.event:
+            case <-done:
+              close(output)
+              return
+          }
+        } else if changed || quietFor >= quiet {
+          schedule(filePath, quiet)
+        } else {
+          schedule(filePath, quiet - quietFor)
         }
-      case ready := <-timeout_channel:
-        waiting[ready.path] = false
-        output <- ready
+      case <-done:
+        close(output)
+        return
     }
   }
 }
 
-func WatchTree(watchPath string, resultChannel chan FileUpdate) {
-  watcher, _ := fsnotify.NewWatcher()
-  watcher.Watch(watchPath)
-  files, err := ioutil.ReadDir(watchPath)
-  check(err)
-  for _, file := range files {
-    processChannel <- FileEvent{path.Join(watchPath, file.Name()), resultChannel}
+func (env *Env) WatchTree(watchPath string, rules *ignore.Rules, index *Index, resultChannel chan FileUpdate) {
+  watcher, err := fsnotify.NewWatcher()
+  if err != nil {
+    log.Printf("Unable to watch %s for changes (%s), scanning it instead", watchPath, err)
+    env.ScanTree(watchPath, rules, index, resultChannel)
+    return
+  }
+  watcherEvents, watcherErrors := watcher.Event, watcher.Error
+  queue := func(filePath string) {
+    env.queue(FileEvent{path: filePath, resultChannel: resultChannel, index: index})
+  }
+  relPath := func(filePath string) string {
+    rel, err := filepath.Rel(watchPath, filePath)
+    check(err)
+    return rel
+  }
+  // Directories that couldn't be watched, and what they looked like when
+  // they were last polled
+  polled := map[string]dirSnapshot{}
+  var pollTicker <-chan time.Time
+  warnedWatchLimit := false
+  startPolling := func(dirPath string) {
+    snapshot, err := snapshotDir(dirPath)
+    if err != nil { return }
+    polled[dirPath] = snapshot
+    if pollTicker == nil {
+      pollTicker = time.Tick(env.configuredPollInterval())
+    }
+  }
+  watch := func(dirPath string) {
+    if watcher == nil {
+      startPolling(dirPath)
+      return
+    }
+    err := watcher.Watch(dirPath)
+    if err == nil {
+      delete(polled, dirPath)
+      return
+    }
+    if err == syscall.ENOSPC {
+      if !warnedWatchLimit {
+        log.Printf("Out of inotify watches; polling %s and any other directories that can't be watched. " +
+                   "Raise fs.inotify.max_user_watches to avoid this.", dirPath)
+        warnedWatchLimit = true
+      }
+    } else {
+      log.Printf("Unable to watch %s (%s), polling it instead", dirPath, err)
+    }
+    startPolling(dirPath)
+  }
+  // Watch a directory and everything beneath it, queueing each file found
+  // along the way.  New directories are passed back through here as they
+  // are created, so that files written into them before the watch was in
+  // place are not missed.
+  var found map[string]bool
+  var watchDir func(dirPath string)
+  watchDir = func(dirPath string) {
+    loadIgnoreFile(rules, watchPath, dirPath)
+    watch(dirPath)
+    files, err := ioutil.ReadDir(dirPath)
+    if err != nil {
+      // Removed since we heard about it; its removal is on its way
+      log.Printf("Error reading %s: %s", dirPath, err)
+      return
+    }
+    for _, file := range files {
+      filePath := path.Join(dirPath, file.Name())
+      if strings.HasPrefix(file.Name(), tempPrefix) || rules.Ignored(relPath(filePath), file.IsDir()) {
+        continue
+      }
+      if file.IsDir() {
+        watchDir(filePath)
+      } else {
+        if found != nil { found[relPath(filePath)] = true }
+        queue(filePath)
+      }
+    }
+  }
+  // Walks the whole tree, queueing everything in it along with anything
+  // indexed that is no longer there.  The index vouches for files that
+  // haven't changed, so only the differences from the last known tree
+  // make it into a revision.
+  rescan := func() {
+    found = map[string]bool{}
+    watchDir(watchPath)
+    for _, name := range index.Paths() {
+      if !found[name] {
+        queue(path.Join(watchPath, name))
+      }
+    }
+    found = nil
+  }
+  // Events were lost, so we can't trust anything short of a full rescan.
+  // Trouble tends to come in bunches, so wait a moment and do just one.
+  var rescanTimer <-chan time.Time
+  rescanSoon := func() {
+    if rescanTimer == nil {
+      rescanTimer = time.After(100 * time.Millisecond)
+    }
+  }
+  // If the watcher itself gives out, everything gets polled from then on
+  watcherClosed := func() {
+    log.Printf("Watcher for %s stopped, polling it instead", watchPath)
+    watcher, watcherEvents, watcherErrors = nil, nil, nil
+    rescan()
   }
+  rescanTicker := time.NewTicker(env.configuredRescanInterval())
+  defer rescanTicker.Stop()
+  rescan()
   for {
     select {
-      case event := <-watcher.Event:
+      case event, ok := <-watcherEvents:
+        if !ok {
+          watcherClosed()
+          continue
+        }
+        if strings.HasPrefix(path.Base(event.Name), tempPrefix) {
+          // One of our own writes in progress
+          continue
+        }
+        if path.Base(event.Name) == ignore.FileName {
+          // Rescan the directory so that anything no longer ignored gets
+          // picked up.  MonitorTree drops whatever is newly ignored.
+          watchDir(path.Dir(event.Name))
+          queue(event.Name)
+          continue
+        }
+        if event.IsCreate() || event.IsModify() {
+          statbuf, err := os.Lstat(event.Name)
+          if err == nil {
+            if rules.Ignored(relPath(event.Name), statbuf.IsDir()) {
+              continue
+            }
+            if event.IsCreate() && statbuf.IsDir() {
+              watchDir(event.Name)
+              continue
+            }
+          }
+        }
         if event.IsCreate() || event.IsModify() || event.IsDelete() || event.IsRename() {
-          processChannel <- FileEvent{event.Name, resultChannel}
+          queue(event.Name)
         } else {
-          log.Fatal("unknown event type", event)
+          log.Printf("Unrecognized watcher event %s, rescanning %s", event, watchPath)
+          rescanSoon()
+        }
+      case err, ok := <-watcherErrors:
+        if !ok {
+          watcherClosed()
+          continue
+        }
+        log.Printf("Watcher error (%s), rescanning %s", err, watchPath)
+        rescanSoon()
+      case <-rescanTimer:
+        rescanTimer = nil
+        rescan()
+      case <-rescanTicker.C:
+        rescan()
+      case <-env.Hub.Done:
+        if watcher != nil {
+          watcher.Close()
+        }
+        return
+      case <-pollTicker:
+        for dirPath, before := range polled {
+          after, err := snapshotDir(dirPath)
+          if err != nil {
+            // Gone, along with everything in it
+            delete(polled, dirPath)
+            queue(dirPath)
+            continue
+          }
+          polled[dirPath] = after
+          for _, name := range before.changes(after) {
+            filePath := path.Join(dirPath, name)
+            stat, exists := after[name]
+            if strings.HasPrefix(name, tempPrefix) || rules.Ignored(relPath(filePath), stat.isDir) {
+              continue
+            }
+            if name == ignore.FileName {
+              // As with a watched directory, pick up anything no longer
+              // ignored
+              watchDir(dirPath)
+            }
+            if exists && stat.isDir {
+              if _, present := before[name]; !present {
+                watchDir(filePath)
+              }
+              continue
+            }
+            queue(filePath)
+          }
         }
-      case error := <-watcher.Error:
-        log.Fatal(error)
     }
   }
 }
 
-func WatchRevisions(commit *types.Commit, revisionChannel chan types.Hash, mergeChannel chan types.Hash) {
+func (env *Env) WatchRevisions(share *Share, commit *types.Commit, revisionChannel chan Revision,
+                    mergeChannel chan MergeRequest) {
   branchReceiveChannel := make(chan types.BranchStatus, 10)
-  subscription := types.BranchSubscription{Name: "origin/master", ResponseChannel: branchReceiveChannel}
-  types.BranchSubscribeChannel <- subscription
+  subscription := types.BranchSubscription{
+    Share: share.Name,
+    Name: "origin/" + share.RemoteBranch,
+    ResponseChannel: branchReceiveChannel,
+  }
+  select {
+    case env.Hub.BranchSubscribeChannel <- subscription:
+    case <-env.Hub.Done:
+      return
+  }
   var lastCommitHash types.Hash
-  updateHead := func(hash types.Hash) {
+  var lastTree types.Hash
+  // Carry on from the last run's head, which ArbitBranchStatus saved
+  head, err := env.Storage.GetRef(share.RefName())
+  if err == nil && head != nil {
+    var headCommit *types.Commit
+    headCommit, err = env.getCommit(context.Background(), head)
+    if err == nil {
+      lastCommitHash, lastTree = head, headCommit.Tree
+    }
+  }
+  if err != nil {
+    log.Printf("Unable to read the head of %s, starting a new history: %s", share.RefName(), err)
+  }
+  updateHead := func(hash types.Hash, tree types.Hash) {
     lastCommitHash = hash
-    storage.Configured().PutRef("master", hash)
+    lastTree = tree
+    select {
+      case env.Hub.BranchUpdateChannel <- types.BranchStatus{Share: share.Name, Name: share.Branch, Hash: hash}:
+      case <-env.Hub.Done:
+    }
+  }
+  name, email := env.configuredIdentity()
+  // Reports whether the commit was made.  If not, the next revision, which
+  // includes everything in this one, tries again.
+  makeCommit := func(tree types.Hash, parents []types.Hash, message string) bool {
+    commit = &types.Commit{
+      Text: commitText(name, email, time.Now(), message),
+      Tree: tree,
+      Parents: parents,
+    }
+    commitHash, err := env.Storage.Put(types.Blob{Commit: commit})
+    if err != nil {
+      log.Printf("Unable to commit to %s: %s", share.RefName(), err)
+      return false
+    }
+    log.Printf("New %s revision: %s", share.RefName(), GetShortHexString(commitHash))
+    updateHead(commitHash, tree)
+    return true
+  }
+  mergeCommit := func(revision Revision, parents []types.Hash) {
+    message := fmt.Sprintf("Merge %s\n", GetHexString(revision.Merge))
+    if len(revision.Conflicts) > 0 {
+      message += "\nConflicts:\n"
+      for _, conflict := range revision.Conflicts {
+        message += fmt.Sprintf("\t%s (from %s kept as %s)\n", conflict.Path, conflict.Peer, conflict.CopyPath)
+      }
+    }
+    if !makeCommit(revision.Tree, parents, message) { return }
+    for _, conflict := range revision.Conflicts {
+      conflict.Commit = lastCommitHash
+      select {
+        case env.Hub.ConflictChannel <- conflict:
+        default:
+      }
+    }
+  }
+  // Commits a tree of local changes on top of the head, if it changed
+  commitLocal := func(tree types.Hash) {
+    before := map[string]*types.TreeEntry{}
+    parents := []types.Hash{}
+    var err error
+    if lastCommitHash != nil {
+      if bytes.Equal(tree, lastTree) { return }
+      before, err = env.FlattenTree(context.Background(), lastTree)
+      parents = append(parents, lastCommitHash)
+    }
+    message := "Update files\n"
+    if err == nil {
+      var after map[string]*types.TreeEntry
+      after, err = env.FlattenTree(context.Background(), tree)
+      if err == nil {
+        message = describeChanges(before, after)
+      }
+    }
+    if err != nil {
+      log.Printf("Unable to list changes for commit: %s", err)
+    }
+    makeCommit(tree, parents, message)
+  }
+  fastForward := func(hash types.Hash, tree types.Hash) {
+    log.Printf("Fast-forwarding to %s", GetShortHexString(hash))
+    updateHead(hash, tree)
+  }
+  // Local revisions are held back until none have arrived for a whole
+  // window and the watcher has gone idle, or until the oldest has waited
+  // maxLatency, so that a burst of changes becomes a single commit.
+  window, maxLatency := env.configuredCommitWindow()
+  var pendingTree types.Hash
+  var pendingSince time.Time
+  var windowTimer <-chan time.Time
+  retention := env.configuredRetention()
+  var retentionTicker <-chan time.Time
+  if retention != nil {
+    retentionTicker = time.NewTicker(retentionCheckInterval).C
   }
   for {
     select {
-      case newHash := <-revisionChannel:
-        cmd := "echo \"`git config --get user.name` <`git config --get user.email`> `date -u +%s` +0000\""
-        authorAndTime, err := exec.Command("bash", "-c", cmd).Output()
+      case revision := <-revisionChannel:
+        if revision.Merge == nil {
+          now := time.Now()
+          if pendingTree == nil {
+            pendingSince = now
+          }
+          pendingTree = revision.Tree
+          wait := window
+          if remaining := pendingSince.Add(maxLatency).Sub(now); remaining < wait {
+            wait = remaining
+          }
+          windowTimer = time.After(wait)
+          continue
+        }
+        // MonitorTree merged into everything it had, so the merge supersedes
+        // whatever local revision was still waiting
+        pendingTree = nil
+        windowTimer = nil
+        mergeCommitBlob, err := env.getCommit(context.Background(), revision.Merge)
         if err != nil {
-          log.Fatalf("Error running shell command: %s", err)
+          log.Printf("Unable to read merged commit %s: %s", GetShortHexString(revision.Merge), err)
+          continue
+        }
+        mergeTree := mergeCommitBlob.Tree
+        matchesMerge := bytes.Equal(revision.Tree, mergeTree)
+        if lastCommitHash == nil {
+          if matchesMerge {
+            fastForward(revision.Merge, mergeTree)
+          } else {
+            mergeCommit(revision, []types.Hash{revision.Merge})
+          }
+        } else if bytes.Equal(lastCommitHash, revision.Merge) ||
+                  env.DoesADescendFromB(lastCommitHash, revision.Merge) {
+          // Already merged in; anything left over is a local change
+          commitLocal(revision.Tree)
+        } else if matchesMerge && env.DoesADescendFromB(revision.Merge, lastCommitHash) {
+          fastForward(revision.Merge, mergeTree)
+        } else if matchesMerge && bytes.Equal(lastTree, mergeTree) {
+          // Both sides arrived at the same tree independently (typically by
+          // merging each other).  Settle on the greater commit hash so that
+          // peers converge rather than merging each other's merges forever.
+          if bytes.Compare(revision.Merge, lastCommitHash) > 0 {
+            fastForward(revision.Merge, mergeTree)
+          }
+        } else {
+          mergeCommit(revision, []types.Hash{lastCommitHash, revision.Merge})
         }
-        commit = &types.Commit{
-          Text: fmt.Sprintf("author %scommitter %s\nawesome\n", authorAndTime, authorAndTime),
-          Tree: newHash,
-          Parents: []types.Hash{}, // this needs the previous *commit* hash
+      case <-windowTimer:
+        remaining := pendingSince.Add(maxLatency).Sub(time.Now())
+        if env.busy() && remaining > 0 {
+          // The watcher is still busy; more changes are on their way
+          if remaining > window { remaining = window }
+          windowTimer = time.After(remaining)
+          continue
         }
-        if lastCommitHash != nil {
-          commit.Parents = append(commit.Parents, lastCommitHash)
+        commitLocal(pendingTree)
+        pendingTree = nil
+        windowTimer = nil
+      case <-retentionTicker:
+        if lastCommitHash == nil || pendingTree != nil { continue }
+        thinned, err := env.Thin(context.Background(), lastCommitHash, retention)
+        if err != nil {
+          log.Printf("Unable to thin the history of %s: %s", share.RefName(), err)
+        } else if !bytes.Equal(thinned, lastCommitHash) {
+          updateHead(thinned, lastTree)
         }
-        commitHash, err := storage.Configured().Put(types.Blob{Commit: commit})
-        check(err)
-        log.Printf("New branch revision: %s", GetShortHexString(commitHash))
-        updateHead(commitHash)
-        types.BranchUpdateChannel <- types.BranchStatus{Name: "master", Hash: commitHash}
       case newBranchStatus := <-branchReceiveChannel:
-        log.Printf("New remote revision: %s", GetShortHexString(newBranchStatus.Hash))
-        updateHead(newBranchStatus.Hash)
-        mergeChannel <- newBranchStatus.Hash
+        remoteHash := newBranchStatus.Hash
+        log.Printf("New remote %s revision: %s", share.Name, GetShortHexString(remoteHash))
+        if !env.Storage.Has(remoteHash) {
+          // Take only as much of the remote's new history as the shallow
+          // policy asks for, whether we're joining the share or have been
+          // away from it a while, before the checks below go looking
+          // through it
+          err := env.FetchShallow(context.Background(), remoteHash)
+          if err != nil {
+            log.Printf("Unable to fetch the history of %s: %s", GetShortHexString(remoteHash), err)
+            continue
+          }
+        }
+        if lastCommitHash != nil && (bytes.Equal(lastCommitHash, remoteHash) ||
+                                     env.DoesADescendFromB(lastCommitHash, remoteHash)) {
+          // We already have everything in it
+          continue
+        }
+        var thinnedSource types.Hash
+        if lastCommitHash != nil && retention != nil {
+          if env.supersededByThinning(lastCommitHash, remoteHash) {
+            // A peer that hasn't caught up with thinning yet
+            continue
+          }
+          var err error
+          thinnedSource, err = env.ThinnedFrom(context.Background(), remoteHash)
+          if err != nil {
+            log.Printf("Unable to check %s for thinning: %s", GetShortHexString(remoteHash), err)
+          }
+          if bytes.Equal(thinnedSource, lastCommitHash) {
+            // The same history, thinned; the tree is unchanged
+            fastForward(remoteHash, lastTree)
+            continue
+          }
+        }
+        var base types.Hash
+        if lastCommitHash != nil {
+          var err error
+          base, err = env.mergeBaseAcrossThinning(context.Background(), lastCommitHash, remoteHash, thinnedSource)
+          if err != nil {
+            log.Printf("Unable to find a merge base with %s: %s", GetShortHexString(remoteHash), err)
+            continue
+          }
+          ahead, behind, err := env.AheadBehind(context.Background(), lastCommitHash, remoteHash)
+          if err == nil {
+            log.Printf("%s: %d local commits not yet on %s, %d remote commits not yet applied",
+                       share.Name, ahead, newBranchStatus.Name, behind)
+          }
+        }
+        select {
+          case mergeChannel <- MergeRequest{Commit: remoteHash, Base: base, Head: lastCommitHash}:
+          case <-env.Hub.Done:
+            return
+        }
+      case <-env.Hub.Done:
+        return
     }
   }
 }
 
-func MakeBranch(path string, previous *types.Commit, root *types.Tree) {
-  revisionChannel := make(chan types.Hash, 10)
-  mergeChannel := make(chan types.Hash, 10)
+// Reports whether any changed file is still on its way through the
+// processors: queued, settling, or being read.
+func (env *Env) busy() bool {
+  if len(env.processChannel) > 0 || len(env.settled) > 0 {
+    return true
+  }
+  if atomic.LoadInt32(&env.settling) > 0 || atomic.LoadInt32(&env.processing) > 0 {
+    return true
+  }
+  for _, worker := range env.workers {
+    if len(worker) > 0 { return true }
+  }
+  return false
+}
+
+// `commit_window_ms` in shared.ini is how long to wait for more changes
+// before committing, and `commit_max_latency_ms` is the longest a change
+// can be held back while they keep coming.
+func (env *Env) configuredCommitWindow() (time.Duration, time.Duration) {
+  window, err := env.Config.GetInt("main", "commit_window_ms")
+  if err != nil || window < 0 {
+    window = 50
+  }
+  maxLatency, err := env.Config.GetInt("main", "commit_max_latency_ms")
+  if err != nil {
+    maxLatency = 1000
+  }
+  if maxLatency < window {
+    maxLatency = window
+  }
+  return time.Duration(window) * time.Millisecond, time.Duration(maxLatency) * time.Millisecond
+}
+
+func (env *Env) MakeBranch(share *Share, previous *types.Commit, root *types.Tree) {
+  revisionChannel := make(chan Revision, 10)
+  mergeChannel := make(chan MergeRequest, 10)
   // if root == nil {
   //   root =
   // }
-  MakeEmptyTreeBlob(path, revisionChannel, mergeChannel)
-  go WatchRevisions(&types.Commit{Tree: types.Hash{}}, revisionChannel, mergeChannel)
+  env.MakeEmptyTreeBlob(share, revisionChannel, mergeChannel)
+  env.Hub.Go(func() { env.WatchRevisions(share, &types.Commit{Tree: types.Hash{}}, revisionChannel, mergeChannel) })
 }
 
-func StartProcessors() {
-  var processImmChannel = make(chan FileEvent, 100)
-  var WORKER_COUNT = 1
-  for i := 0; i < WORKER_COUNT; i++ {
-    go processChange(processImmChannel)
+// Events for a given path always go to the same worker, so that a later
+// event can never overtake an earlier one for the same file.
+func dispatch(workers []chan FileEvent, input chan FileEvent, done <-chan struct{}) {
+  for event := range input {
+    h := fnv.New32a()
+    h.Write([]byte(event.path))
+    select {
+      case workers[h.Sum32() % uint32(len(workers))] <- event:
+      case <-done:
+        return
+    }
+  }
+}
+
+// The number of files read, hashed and stored at once is set by `workers`
+// in shared.ini, and defaults to the number of CPUs.
+func (env *Env) configuredWorkerCount() int {
+  workerCount, err := env.Config.GetInt("main", "workers")
+  if err != nil || workerCount < 1 {
+    return runtime.NumCPU()
   }
-  go debounce(processImmChannel, processChannel)
+  return workerCount
+}
+
+func (env *Env) StartProcessors() {
+  processImmChannel := make(chan FileEvent, 100)
+  workers := []chan FileEvent{}
+  for i := 0; i < env.configuredWorkerCount(); i++ {
+    worker := make(chan FileEvent, 100)
+    workers = append(workers, worker)
+    env.Hub.Go(func() { env.processChange(worker) })
+  }
+  env.settled, env.workers = processImmChannel, workers
+  env.Hub.Go(func() {
+    dispatch(workers, processImmChannel, env.Hub.Done)
+    for _, worker := range workers {
+      close(worker)
+    }
+  })
+  quiet, maxWait := env.configuredSettleTimes()
+  env.Hub.Go(func() { debounce(processImmChannel, env.processChannel, env.Hub.Done, quiet, maxWait, &env.settling) })
 }
@@ -0,0 +1,274 @@
+package blob
+
+import (
+  "bytes"
+  "context"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "path"
+  "sync/atomic"
+  "testing"
+  "time"
+  conf "github.com/tillberg/goconfig"
+  "../ignore"
+  "../types"
+)
+
+func TestDispatchKeepsPathsOnOneWorker(t *testing.T) {
+  workers := []chan FileEvent{}
+  for i := 0; i < 4; i++ {
+    workers = append(workers, make(chan FileEvent, 100))
+  }
+  input := make(chan FileEvent, 100)
+  for i := 0; i < 40; i++ {
+    input <- FileEvent{path: fmt.Sprintf("file%d", i % 10)}
+  }
+  close(input)
+  dispatch(workers, input, make(chan struct{}))
+  seenOn := map[string]int{}
+  for i, worker := range workers {
+    close(worker)
+    for event := range worker {
+      if previous, present := seenOn[event.path]; present && previous != i {
+        t.Errorf("%s went to workers %d and %d", event.path, previous, i)
+      }
+      seenOn[event.path] = i
+    }
+  }
+  if len(seenOn) != 10 {
+    t.Errorf("Expected 10 distinct paths, got %d", len(seenOn))
+  }
+}
+
+func TestDebounceWaitsForWritesToSettle(t *testing.T) {
+  root, err := ioutil.TempDir("", "shared-debounce")
+  if err != nil { t.Fatal(err) }
+  defer os.RemoveAll(root)
+  filePath := path.Join(root, "file")
+  tempPath := path.Join(root, "file.tmp")
+  input := make(chan FileEvent, 100)
+  output := make(chan FileEvent, 100)
+  var settling int32
+  go debounce(output, input, nil, 30 * time.Millisecond, time.Second, &settling)
+  // An editor writing a temporary file in pieces, then renaming it over the
+  // original
+  start := time.Now()
+  for i := 0; i < 5; i++ {
+    ioutil.WriteFile(tempPath, []byte(fmt.Sprintf("part %d", i)), 0644)
+    input <- FileEvent{path: tempPath}
+    time.Sleep(10 * time.Millisecond)
+  }
+  if atomic.LoadInt32(&settling) != 1 {
+    t.Errorf("Expected one path to be settling, got %d", atomic.LoadInt32(&settling))
+  }
+  os.Rename(tempPath, filePath)
+  input <- FileEvent{path: tempPath}
+  input <- FileEvent{path: filePath}
+  seen := map[string]int{}
+  for len(seen) < 2 {
+    select {
+      case event := <-output:
+        seen[event.path]++
+      case <-time.After(time.Second):
+        t.Fatalf("Expected events for both paths, got %v", seen)
+    }
+  }
+  if time.Since(start) < 80 * time.Millisecond {
+    t.Errorf("Events were released before the writes settled")
+  }
+  if seen[tempPath] != 1 || seen[filePath] != 1 {
+    t.Errorf("Expected a single event per path, got %v", seen)
+  }
+  if atomic.LoadInt32(&settling) != 0 {
+    t.Errorf("Expected nothing to be left settling, got %d", atomic.LoadInt32(&settling))
+  }
+  _, err = os.Lstat(tempPath)
+  if !os.IsNotExist(err) {
+    t.Errorf("The temporary file should be gone by the time it is released")
+  }
+}
+
+func TestMergeReportsConflicts(t *testing.T) {
+  store := memStorage{}
+  env := &Env{Hub: types.NewHub(), Storage: store, Config: conf.NewConfigFile()}
+  defer close(env.Hub.Done)
+  remote, err := store.Put(types.Blob{Commit: &types.Commit{
+    Tree: types.Hash{1},
+    Parents: []types.Hash{},
+    Text: commitText("peer", "peer@example.com", time.Now(), "change\n"),
+  }})
+  if err != nil { t.Fatal(err) }
+  revisionChannel := make(chan Revision, 10)
+  share := &Share{Name: "docs", Branch: "master", RemoteBranch: "master"}
+  go env.WatchRevisions(share, nil, revisionChannel, make(chan MergeRequest, 10))
+  conflict := types.Conflict{Path: "notes.txt", CopyPath: "notes (peer).txt", Peer: "peer"}
+  revisionChannel <- Revision{Tree: types.Hash{2}, Merge: remote, Conflicts: []types.Conflict{conflict}}
+  select {
+    case reported := <-env.Hub.ConflictChannel:
+      if reported.Path != conflict.Path || reported.Commit == nil {
+        t.Errorf("Expected the conflict in %s along with its merge commit, got %v", conflict.Path, reported)
+      }
+    case <-time.After(time.Second):
+      t.Fatalf("No conflict was reported")
+  }
+}
+
+func TestProcessorsStopWithTheHub(t *testing.T) {
+  env := NewEnv(types.NewHub(), memStorage{}, "", conf.NewConfigFile())
+  env.StartProcessors()
+  resultChannel := make(chan FileUpdate)
+  // Nobody reads the result, so this leaves a worker waiting to send it
+  env.queue(FileEvent{path: "/nonexistent", resultChannel: resultChannel, index: &Index{}})
+  time.Sleep(50 * time.Millisecond)
+  close(env.Hub.Done)
+  stopped := make(chan struct{})
+  go func() {
+    env.Hub.Wait()
+    close(stopped)
+  }()
+  select {
+    case <-stopped:
+    case <-time.After(time.Second):
+      t.Fatalf("Processors were still running after the hub was stopped")
+  }
+}
+
+func TestWatchTreeRescansPeriodically(t *testing.T) {
+  root, err := ioutil.TempDir("", "shared-rescan")
+  if err != nil { t.Fatal(err) }
+  defer os.RemoveAll(root)
+  config := conf.NewConfigFile()
+  config.AddOption("main", "rescan_ms", "50")
+  env := NewEnv(types.NewHub(), memStorage{}, root, config)
+  defer close(env.Hub.Done)
+  // Tracked, but deleted without the watcher hearing about it
+  index := LoadIndex(path.Join(root, "index"), root)
+  index.Track("ghost")
+  go env.WatchTree(root, ignore.New(nil), index, make(chan FileUpdate, 10))
+  ghost := path.Join(root, "ghost")
+  for seen := 0; seen < 2; {
+    select {
+      case event := <-env.processChannel:
+        if event.path == ghost { seen++ }
+      case <-time.After(time.Second):
+        t.Fatalf("Expected %s to be queued by the initial scan and again by a rescan", ghost)
+    }
+  }
+}
+
+func TestBurstMakesOneCommit(t *testing.T) {
+  store := memStorage{}
+  for i := byte(1); i <= 2; i++ {
+    store[GetHexString(types.Hash{i})] = types.Blob{Tree: &types.Tree{}}
+  }
+  config := conf.NewConfigFile()
+  config.AddOption("main", "commit_window_ms", "20")
+  env := NewEnv(types.NewHub(), store, "", config)
+  defer close(env.Hub.Done)
+  revisionChannel := make(chan Revision, 10)
+  share := &Share{Name: "docs", Branch: "master", RemoteBranch: "master"}
+  go env.WatchRevisions(share, nil, revisionChannel, make(chan MergeRequest, 10))
+  // The first files of a burst make a revision while the rest are still
+  // settling, for longer than the commit window
+  atomic.StoreInt32(&env.settling, 1)
+  revisionChannel <- Revision{Tree: types.Hash{1}}
+  time.Sleep(60 * time.Millisecond)
+  revisionChannel <- Revision{Tree: types.Hash{2}}
+  time.Sleep(60 * time.Millisecond)
+  atomic.StoreInt32(&env.settling, 0)
+  commits := []types.Hash{}
+  timeout := time.After(200 * time.Millisecond)
+  for waiting := true; waiting; {
+    select {
+      case update := <-env.Hub.BranchUpdateChannel:
+        commits = append(commits, update.Hash)
+      case <-timeout:
+        waiting = false
+    }
+  }
+  if len(commits) != 1 {
+    t.Fatalf("Expected the burst to make a single commit, got %d", len(commits))
+  }
+  commit, err := env.getCommit(context.Background(), commits[0])
+  if err != nil || commit.Tree[0] != 2 {
+    t.Errorf("Expected the commit to have the last tree of the burst: %v", err)
+  }
+}
+
+func TestWatchRevisionsResumesFromHead(t *testing.T) {
+  store := gcStorage{memStorage: memStorage{}, refs: map[string]types.Hash{}}
+  fileHash, _ := store.Put(types.Blob{File: &types.File{Bytes: []byte("hello")}})
+  oldTree, _ := store.Put(types.Blob{Tree: &types.Tree{Entries: []*types.TreeEntry{
+    {Hash: fileHash, Name: "file", Flags: modeFile},
+  }}})
+  newTree, _ := store.Put(types.Blob{Tree: &types.Tree{Entries: []*types.TreeEntry{}}})
+  head, _ := store.Put(types.Blob{Commit: &types.Commit{
+    Tree: oldTree,
+    Parents: []types.Hash{},
+    Text: commitText("me", "me@example.com", time.Now(), "Add file\n"),
+  }})
+  share := &Share{Name: "docs", Branch: "master", RemoteBranch: "master"}
+  store.refs[share.RefName()] = head
+  config := conf.NewConfigFile()
+  config.AddOption("main", "commit_window_ms", "20")
+  env := NewEnv(types.NewHub(), store, "", config)
+  defer close(env.Hub.Done)
+  revisionChannel := make(chan Revision, 10)
+  go env.WatchRevisions(share, nil, revisionChannel, make(chan MergeRequest, 10))
+  // Nothing changed since the last run, so nothing to commit
+  revisionChannel <- Revision{Tree: oldTree}
+  select {
+    case update := <-env.Hub.BranchUpdateChannel:
+      t.Fatalf("Expected no commit for the tree already at the head, got %x", update.Hash)
+    case <-time.After(100 * time.Millisecond):
+  }
+  revisionChannel <- Revision{Tree: newTree}
+  select {
+    case update := <-env.Hub.BranchUpdateChannel:
+      commit, err := env.getCommit(context.Background(), update.Hash)
+      if err != nil { t.Fatal(err) }
+      if len(commit.Parents) != 1 || !bytes.Equal(commit.Parents[0], head) {
+        t.Errorf("Expected the new commit to follow on from the stored head, got parents %x", commit.Parents)
+      }
+    case <-time.After(time.Second):
+      t.Fatalf("No commit was made")
+  }
+}
+
+func TestFileReplacedByDirectory(t *testing.T) {
+  root, err := ioutil.TempDir("", "shared-replace")
+  if err != nil { t.Fatal(err) }
+  defer os.RemoveAll(root)
+  store := memStorage{}
+  env := NewEnv(types.NewHub(), store, root, conf.NewConfigFile())
+  defer close(env.Hub.Done)
+  share := &Share{Name: "docs", Root: path.Join(root, "share")}
+  os.MkdirAll(path.Join(share.Root, "a"), 0755)
+  ioutil.WriteFile(path.Join(share.Root, "a", "x"), []byte("x"), 0644)
+  index := LoadIndex(path.Join(root, "index"), share.Root)
+  index.Track("a")
+  // `a` was committed as a file, and has since become a directory
+  children := map[string]*types.TreeEntry{"a": {Hash: types.Hash{9}, Name: "a", Flags: modeFile}}
+  fileUpdates := make(chan FileUpdate, 10)
+  for _, name := range []string{"a", "a/x"} {
+    env.processEvent(FileEvent{path: path.Join(share.Root, name), resultChannel: fileUpdates, index: index})
+  }
+  revisionChannel := make(chan Revision, 10)
+  go env.MonitorTree(share, ignore.New(nil), index, children, fileUpdates, make(chan MergeRequest), revisionChannel)
+  select {
+    case revision := <-revisionChannel:
+      flattened, err := env.FlattenTree(context.Background(), revision.Tree)
+      if err != nil { t.Fatal(err) }
+      if len(flattened) != 1 || flattened["a/x"] == nil {
+        t.Errorf("Expected only a/x in the tree, got %v", flattened)
+      }
+    case <-time.After(time.Second):
+      t.Fatalf("No revision was made")
+  }
+  for _, name := range index.Paths() {
+    if name == "a" {
+      t.Errorf("Expected the file a to have been dropped from the index")
+    }
+  }
+}
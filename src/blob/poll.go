@@ -0,0 +1,184 @@
+package blob
+
+import (
+  "io/ioutil"
+  "log"
+  "os"
+  "path"
+  "path/filepath"
+  "strings"
+  "syscall"
+  "time"
+  "../ignore"
+)
+
+// Directories that can't be watched with inotify are polled instead, by
+// comparing what they contain from one look to the next.
+type statSnapshot struct {
+  isDir   bool
+  size    int64
+  mode    os.FileMode
+  modTime time.Time
+}
+
+func snapshotOf(info os.FileInfo) statSnapshot {
+  return statSnapshot{isDir: info.IsDir(), size: info.Size(), mode: info.Mode(), modTime: info.ModTime()}
+}
+
+func (stat statSnapshot) same(other statSnapshot) bool {
+  return stat.isDir == other.isDir && stat.size == other.size && stat.mode == other.mode &&
+         stat.modTime.Equal(other.modTime)
+}
+
+type dirSnapshot map[string]statSnapshot
+
+func snapshotDir(dirPath string) (dirSnapshot, error) {
+  files, err := ioutil.ReadDir(dirPath)
+  if err != nil { return nil, err }
+  snapshot := dirSnapshot{}
+  for _, file := range files {
+    snapshot[file.Name()] = snapshotOf(file)
+  }
+  return snapshot, nil
+}
+
+// Lists the names that appeared, disappeared or changed since before
+func (before dirSnapshot) changes(after dirSnapshot) []string {
+  names := []string{}
+  for name, stat := range after {
+    previous, present := before[name]
+    if !present || !previous.same(stat) {
+      names = append(names, name)
+    }
+  }
+  for name := range before {
+    if _, present := after[name]; !present {
+      names = append(names, name)
+    }
+  }
+  return names
+}
+
+// `poll_ms` in shared.ini is how often polled directories, and shares that
+// are scanned rather than watched, are checked
+func (env *Env) configuredPollInterval() time.Duration {
+  interval, err := env.Config.GetInt("main", "poll_ms")
+  if err != nil || interval < 1 {
+    interval = 1000
+  }
+  return time.Duration(interval) * time.Millisecond
+}
+
+// `rescan_ms` in shared.ini is how often a watched share is walked in full
+// anyway, to pick up whatever the watcher missed.  The kernel drops events
+// when its queue overflows, and this version of fsnotify doesn't say so.
+func (env *Env) configuredRescanInterval() time.Duration {
+  interval, err := env.Config.GetInt("main", "rescan_ms")
+  if err != nil || interval < 1 {
+    interval = 10 * 60 * 1000
+  }
+  return time.Duration(interval) * time.Millisecond
+}
+
+// Filesystems that accept inotify watches but never deliver events for
+// changes made by other machines, by statfs magic number
+var unwatchableFilesystems = map[int64]string{
+  0x6969: "NFS",
+  0x517b: "SMB",
+  0xff534d42: "CIFS",
+  0xfe534d42: "SMB2",
+  0x65735546: "FUSE",
+}
+
+// Reports the kind of filesystem dirPath is on, if it's one that has to be
+// scanned for changes
+func unwatchableFilesystem(dirPath string) (string, bool) {
+  var statfs syscall.Statfs_t
+  if syscall.Statfs(dirPath, &statfs) != nil {
+    return "", false
+  }
+  // The magic number is signed on some platforms
+  kind, present := unwatchableFilesystems[int64(statfs.Type) & 0xffffffff]
+  return kind, present
+}
+
+func loadIgnoreFile(rules *ignore.Rules, rootPath string, dirPath string) {
+  rel, err := filepath.Rel(rootPath, dirPath)
+  check(err)
+  data, err := ioutil.ReadFile(path.Join(dirPath, ignore.FileName))
+  if err != nil {
+    rules.Remove(rel)
+  } else {
+    rules.Load(rel, data)
+  }
+}
+
+// ScanTree stands in for WatchTree where inotify can't be relied on.  It
+// walks the whole tree every poll interval, queueing each file whose stat
+// info differs from the last walk, along with any that have gone missing.
+func (env *Env) ScanTree(watchPath string, rules *ignore.Rules, index *Index, resultChannel chan FileUpdate) {
+  interval := env.configuredPollInterval()
+  queue := func(filePath string) {
+    env.queue(FileEvent{path: filePath, resultChannel: resultChannel, index: index})
+  }
+  relPath := func(filePath string) string {
+    rel, err := filepath.Rel(watchPath, filePath)
+    check(err)
+    return rel
+  }
+  // Stat info as of the last walk, by path relative to watchPath
+  cache := map[string]statSnapshot{}
+  var seen map[string]bool
+  var walk func(dirPath string)
+  walk = func(dirPath string) {
+    loadIgnoreFile(rules, watchPath, dirPath)
+    files, err := ioutil.ReadDir(dirPath)
+    if err != nil {
+      log.Printf("Error reading %s: %s", dirPath, err)
+      return
+    }
+    for _, file := range files {
+      filePath := path.Join(dirPath, file.Name())
+      rel := relPath(filePath)
+      if strings.HasPrefix(file.Name(), tempPrefix) || rules.Ignored(rel, file.IsDir()) {
+        continue
+      }
+      if file.IsDir() {
+        walk(filePath)
+        continue
+      }
+      seen[rel] = true
+      stat := snapshotOf(file)
+      if previous, present := cache[rel]; present && previous.same(stat) {
+        continue
+      }
+      cache[rel] = stat
+      queue(filePath)
+    }
+  }
+  log.Printf("Scanning %s for changes every %s", watchPath, interval)
+  for first := true; ; first = false {
+    seen = map[string]bool{}
+    walk(watchPath)
+    for rel := range cache {
+      if !seen[rel] {
+        delete(cache, rel)
+        queue(path.Join(watchPath, rel))
+      }
+    }
+    if first {
+      // Anything indexed but not found was removed (or became ignored)
+      // while we weren't looking
+      for _, name := range index.Paths() {
+        if !seen[name] {
+          queue(path.Join(watchPath, name))
+        }
+      }
+    }
+    select {
+      case <-time.After(interval):
+      case <-env.Hub.Done:
+        return
+    }
+  }
+}
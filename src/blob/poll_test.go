@@ -0,0 +1,97 @@
+package blob
+
+import (
+  "io/ioutil"
+  "os"
+  "path"
+  "sort"
+  "testing"
+  "time"
+  conf "github.com/tillberg/goconfig"
+  "../ignore"
+  "../types"
+)
+
+func TestDirSnapshotChanges(t *testing.T) {
+  then := time.Unix(1361048340, 0)
+  before := dirSnapshot{
+    "same": {size: 1, modTime: then},
+    "resized": {size: 1, modTime: then},
+    "touched": {size: 1, modTime: then},
+    "removed": {size: 1, modTime: then},
+    "dir": {isDir: true, modTime: then},
+  }
+  after := dirSnapshot{
+    "same": {size: 1, modTime: then},
+    "resized": {size: 2, modTime: then},
+    "touched": {size: 1, modTime: then.Add(time.Second)},
+    "added": {size: 1, modTime: then},
+    "dir": {isDir: true, modTime: then.Add(time.Second)},
+  }
+  changes := before.changes(after)
+  sort.Strings(changes)
+  expected := []string{"added", "dir", "removed", "resized", "touched"}
+  if len(changes) != len(expected) {
+    t.Fatalf("Expected %v, got %v", expected, changes)
+  }
+  for i := range expected {
+    if changes[i] != expected[i] {
+      t.Fatalf("Expected %v, got %v", expected, changes)
+    }
+  }
+}
+
+func TestScanTree(t *testing.T) {
+  root, err := ioutil.TempDir("", "shared-scan")
+  if err != nil { t.Fatal(err) }
+  defer os.RemoveAll(root)
+  share := path.Join(root, "share")
+  os.MkdirAll(path.Join(share, "dir"), 0755)
+  ioutil.WriteFile(path.Join(share, "changed"), []byte("a"), 0644)
+  ioutil.WriteFile(path.Join(share, "dir", "removed"), []byte("a"), 0644)
+  ioutil.WriteFile(path.Join(share, "ignored.tmp"), []byte("a"), 0644)
+  ioutil.WriteFile(path.Join(share, tempPrefix + "123"), []byte("a"), 0644)
+  ioutil.WriteFile(path.Join(share, ignore.FileName), []byte("*.tmp\n"), 0644)
+  config := conf.NewConfigFile()
+  config.AddOption("main", "poll_ms", "50")
+  env := NewEnv(types.NewHub(), memStorage{}, root, config)
+  defer close(env.Hub.Done)
+  // Tracked, but deleted while nobody was looking
+  index := LoadIndex(path.Join(root, "index"), share)
+  index.Track("ghost")
+  go env.ScanTree(share, ignore.New(nil), index, make(chan FileUpdate, 10))
+  // Waits for just the given paths to be queued, and then for a few more
+  // scans to pass without anything else
+  expect := func(names ...string) {
+    expected := map[string]bool{}
+    for _, name := range names {
+      expected[path.Join(share, name)] = true
+    }
+    timeout := time.After(time.Second)
+    quiet := time.After(time.Hour)
+    for {
+      select {
+        case event := <-env.processChannel:
+          if !expected[event.path] {
+            t.Errorf("Unexpected event for %s", event.path)
+          }
+          delete(expected, event.path)
+          if len(expected) == 0 {
+            quiet = time.After(200 * time.Millisecond)
+          }
+        case <-quiet:
+          return
+        case <-timeout:
+          if len(expected) > 0 {
+            t.Fatalf("Expected events for %v", expected)
+          }
+      }
+    }
+  }
+  expect("changed", "dir/removed", ignore.FileName, "ghost")
+  ioutil.WriteFile(path.Join(share, "changed"), []byte("ab"), 0644)
+  os.Remove(path.Join(share, "dir", "removed"))
+  ioutil.WriteFile(path.Join(share, "dir", "added"), []byte("a"), 0644)
+  ioutil.WriteFile(path.Join(share, "added.tmp"), []byte("a"), 0644)
+  expect("changed", "dir/removed", "dir/added")
+}
@@ -0,0 +1,82 @@
+package blob
+
+import (
+  "context"
+  "sync"
+  "../types"
+)
+
+// How many objects Prefetch asks peers for at once
+const maxPrefetchInFlight = 64
+
+type prefetcher struct {
+  env    *Env
+  ctx    context.Context
+  cancel context.CancelFunc
+  slots  chan bool
+  wait   sync.WaitGroup
+  mutex  sync.Mutex
+  seen   map[string]bool
+  err    error
+}
+
+// Prefetch makes sure that a commit, its tree and every file in it are in
+// the cache, fetching whatever is missing from peers.  Each object's
+// children are requested as soon as it arrives, with many requests in
+// flight at once, so that the whole tree takes about as many round trips as
+// it is deep rather than one per object.
+func (env *Env) Prefetch(ctx context.Context, commit types.Hash) error {
+  fetcher := &prefetcher{env: env, slots: make(chan bool, maxPrefetchInFlight), seen: map[string]bool{}}
+  fetcher.ctx, fetcher.cancel = context.WithCancel(ctx)
+  defer fetcher.cancel()
+  fetcher.fetch(commit, false)
+  fetcher.wait.Wait()
+  return fetcher.err
+}
+
+// Records the first failure, which calls off everything else
+func (fetcher *prefetcher) fail(err error) {
+  fetcher.mutex.Lock()
+  defer fetcher.mutex.Unlock()
+  if fetcher.err == nil {
+    fetcher.err = err
+    fetcher.cancel()
+  }
+}
+
+// Files need only be present, but commits and trees are read (from the
+// cache, if they're already there) to find what they refer to.
+func (fetcher *prefetcher) fetch(hash types.Hash, isFile bool) {
+  fetcher.mutex.Lock()
+  key := GetHexString(hash)
+  seen := fetcher.seen[key]
+  fetcher.seen[key] = true
+  fetcher.mutex.Unlock()
+  if seen || (isFile && fetcher.env.Storage.Has(hash)) {
+    return
+  }
+  fetcher.wait.Add(1)
+  go func() {
+    defer fetcher.wait.Done()
+    select {
+      case fetcher.slots <- true:
+      case <-fetcher.ctx.Done():
+        fetcher.fail(fetcher.ctx.Err())
+        return
+    }
+    blob, err := fetcher.env.GetBlob(fetcher.ctx, hash)
+    <-fetcher.slots
+    if err != nil {
+      fetcher.fail(err)
+      return
+    }
+    if blob.Commit != nil {
+      fetcher.fetch(blob.Commit.Tree, false)
+    }
+    if blob.Tree != nil {
+      for _, entry := range blob.Tree.Entries {
+        fetcher.fetch(entry.Hash, entry.Flags != modeTree)
+      }
+    }
+  }()
+}
@@ -0,0 +1,79 @@
+package blob
+
+import (
+  "context"
+  "testing"
+  "time"
+  conf "github.com/tillberg/goconfig"
+  "../types"
+)
+
+// commit -> tree -> {a, link, dir -> {b}}, stored in peer
+func prefetchHistory(peer memStorage) (commit types.Hash, objects []types.Hash) {
+  put := func(blob types.Blob) types.Hash {
+    hash, _ := peer.Put(blob)
+    objects = append(objects, hash)
+    return hash
+  }
+  a := put(types.Blob{File: &types.File{Bytes: []byte("a")}})
+  b := put(types.Blob{File: &types.File{Bytes: []byte("b")}})
+  link := put(types.Blob{File: &types.File{Bytes: []byte("dir/b")}})
+  dir := put(types.Blob{Tree: &types.Tree{Entries: []*types.TreeEntry{{Hash: b, Name: "b", Flags: modeFile}}}})
+  tree := put(types.Blob{Tree: &types.Tree{Entries: []*types.TreeEntry{
+    {Hash: a, Name: "a", Flags: modeFile},
+    {Hash: link, Name: "link", Flags: modeSymlink},
+    {Hash: dir, Name: "dir", Flags: modeTree},
+  }}})
+  commit = put(types.Blob{Commit: &types.Commit{Tree: tree, Parents: []types.Hash{}, Text: "change\n"}})
+  return commit, objects
+}
+
+func TestPrefetch(t *testing.T) {
+  peer, local := memStorage{}, memStorage{}
+  commit, objects := prefetchHistory(peer)
+  env := NewEnv(types.NewHub(), local, "", conf.NewConfigFile())
+  defer close(env.Hub.Done)
+  go servePeer(env, local, peer)
+  err := env.Prefetch(context.Background(), commit)
+  if err != nil { t.Fatal(err) }
+  for _, hash := range objects {
+    if !local.Has(hash) {
+      t.Errorf("Expected %x to have been fetched", hash)
+    }
+  }
+}
+
+func TestPrefetchStopsAtFirstFailure(t *testing.T) {
+  peer, local := memStorage{}, memStorage{}
+  commit, _ := prefetchHistory(peer)
+  // The peer has lost one file, and never answers for the other
+  missing, _ := peer.Put(types.Blob{File: &types.File{Bytes: []byte("b")}})
+  stalled, _ := peer.Put(types.Blob{File: &types.File{Bytes: []byte("a")}})
+  delete(peer, GetHexString(missing))
+  env := NewEnv(types.NewHub(), local, "", conf.NewConfigFile())
+  defer close(env.Hub.Done)
+  go func() {
+    for {
+      select {
+        case request := <-env.Hub.BlobRequestChannel:
+          if GetHexString(request.Hash) == GetHexString(stalled) { continue }
+          blob, present := peer[GetHexString(request.Hash)]
+          if present {
+            local[GetHexString(request.Hash)] = blob
+          }
+          request.ResponseChannel <- types.BlobResponse{Hash: request.Hash, Found: present}
+        case <-env.Hub.Done:
+          return
+      }
+    }
+  }()
+  start := time.Now()
+  err := env.Prefetch(context.Background(), commit)
+  if err != ErrBlobNotFound {
+    t.Errorf("Expected ErrBlobNotFound, got %v", err)
+  }
+  // Rather than the fetch timeout, for the stalled request
+  if time.Since(start) > 5 * time.Second {
+    t.Errorf("Expected the failure to call off the rest of the prefetch")
+  }
+}
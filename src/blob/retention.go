@@ -0,0 +1,241 @@
+package blob
+
+import (
+  "bytes"
+  "context"
+  "encoding/hex"
+  "fmt"
+  "log"
+  "regexp"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+  "../types"
+)
+
+// How often each share's history is checked against the retention policy
+const retentionCheckInterval = time.Hour
+
+// Commits within age of the newest are kept one per interval, or all of
+// them if interval is zero.
+type retentionTier struct {
+  age      time.Duration
+  interval time.Duration
+}
+
+var retentionIntervals = map[string]time.Duration{
+  "all": 0,
+  "hourly": time.Hour,
+  "daily": 24 * time.Hour,
+  "weekly": 7 * 24 * time.Hour,
+}
+
+// Durations as time.ParseDuration has them, plus days and weeks
+func parseAge(text string) (time.Duration, error) {
+  for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+    if strings.HasSuffix(text, suffix) {
+      count, err := strconv.Atoi(strings.TrimSuffix(text, suffix))
+      if err != nil { return 0, fmt.Errorf("invalid age: %s", text) }
+      return time.Duration(count) * unit, nil
+    }
+  }
+  return time.ParseDuration(text)
+}
+
+// Parses a retention policy such as `all 24h, hourly 30d, daily 365d`: keep
+// every commit for a day, then one an hour for 30 days, then one a day for a
+// year, and nothing older.  An interval may also be given as a duration.
+func parseRetention(text string) ([]retentionTier, error) {
+  tiers := []retentionTier{}
+  for _, part := range strings.Split(text, ",") {
+    fields := strings.Fields(part)
+    if len(fields) == 0 { continue }
+    if len(fields) != 2 {
+      return nil, fmt.Errorf("expected an interval and an age: %s", part)
+    }
+    interval, known := retentionIntervals[fields[0]]
+    if !known {
+      var err error
+      interval, err = parseAge(fields[0])
+      if err != nil { return nil, err }
+    }
+    age, err := parseAge(fields[1])
+    if err != nil { return nil, err }
+    tiers = append(tiers, retentionTier{age: age, interval: interval})
+  }
+  sort.Slice(tiers, func(i, j int) bool { return tiers[i].age < tiers[j].age })
+  return tiers, nil
+}
+
+// `retention` in shared.ini thins out old history (see parseRetention).
+// Without it, every commit is kept forever.
+func (env *Env) configuredRetention() []retentionTier {
+  text, err := env.Config.GetString("main", "retention")
+  if err != nil || text == "" { return nil }
+  tiers, err := parseRetention(text)
+  if err != nil {
+    log.Printf("Ignoring retention policy: %s", err)
+    return nil
+  }
+  return tiers
+}
+
+// Picks which of a chain of commit times, newest first, to keep.  Ages are
+// measured from the newest commit rather than the clock, so that every peer
+// thinning the same history arrives at the same commits.  Within each
+// interval, the newest commit is kept.
+func thinnedCommits(times []time.Time, tiers []retentionTier) []bool {
+  keep := make([]bool, len(times))
+  if len(times) == 0 { return keep }
+  keep[0] = true
+  type bucket struct {
+    tier  int
+    slot  int64
+  }
+  filled := map[bucket]bool{}
+  for i := 1; i < len(times); i++ {
+    age := times[0].Sub(times[i])
+    for t, tier := range tiers {
+      if age > tier.age { continue }
+      if tier.interval == 0 {
+        keep[i] = true
+      } else {
+        slot := bucket{tier: t, slot: times[i].Unix() / int64(tier.interval / time.Second)}
+        keep[i] = !filled[slot]
+        filled[slot] = true
+      }
+      break
+    }
+  }
+  return keep
+}
+
+// The newest commit of a thinned chain names the commit it was thinned
+// from, so that peers can check the rewrite and adopt it.
+var regexpThinnedFrom = regexp.MustCompile(`(?m)^Thinned-from: ([0-9a-f]+)\n`)
+
+func thinnedFrom(commit *types.Commit) types.Hash {
+  submatch := regexpThinnedFrom.FindStringSubmatch(commit.Text)
+  if submatch == nil { return nil }
+  hash, err := hex.DecodeString(submatch[1])
+  if err != nil { return nil }
+  return hash
+}
+
+func withThinnedFrom(text string, source types.Hash) string {
+  text = strings.TrimRight(regexpThinnedFrom.ReplaceAllString(text, ""), "\n")
+  return fmt.Sprintf("%s\n\nThinned-from: %s\n", text, hex.EncodeToString(source))
+}
+
+// Thin rewrites the first-parent history of tip according to the retention
+// policy into a chain of the commits kept, each with its tree and message
+// but only the next kept commit as its parent.  It returns tip unchanged if
+// nothing would be dropped.  The rewrite depends only on the history and the
+// policy, so peers with the same policy rewrite the same tip identically.
+func (env *Env) Thin(ctx context.Context, tip types.Hash, tiers []retentionTier) (types.Hash, error) {
+  commits := []*types.Commit{}
+  times := []time.Time{}
+  for hash := tip; hash != nil; {
+    commit, err := env.getCommit(ctx, hash)
+    if err != nil { return nil, err }
+    _, when := commitAuthor(commit)
+    commits = append(commits, commit)
+    times = append(times, when)
+    if len(commit.Parents) == 0 || env.IsShallow(hash) {
+      // As far back as history goes here
+      break
+    }
+    hash = commit.Parents[0]
+  }
+  keep := thinnedCommits(times, tiers)
+  dropped := 0
+  for _, kept := range keep {
+    if !kept { dropped++ }
+  }
+  if dropped == 0 { return tip, nil }
+  var parent types.Hash
+  for i := len(commits) - 1; i >= 0; i-- {
+    if !keep[i] { continue }
+    rewritten := &types.Commit{Tree: commits[i].Tree, Parents: []types.Hash{}, Text: commits[i].Text}
+    if parent != nil {
+      rewritten.Parents = append(rewritten.Parents, parent)
+    }
+    if i == 0 {
+      rewritten.Text = withThinnedFrom(rewritten.Text, tip)
+    }
+    var err error
+    parent, err = env.Storage.Put(types.Blob{Commit: rewritten})
+    if err != nil { return nil, err }
+  }
+  log.Printf("Thinned %s to %s, dropping %d of %d commits", GetShortHexString(tip), GetShortHexString(parent),
+             dropped, len(commits))
+  return parent, nil
+}
+
+// ThinnedFrom returns the commit that remote was thinned from, if it was,
+// and if thinning that commit under our own policy gives remote, too.
+func (env *Env) ThinnedFrom(ctx context.Context, remote types.Hash) (types.Hash, error) {
+  tiers := env.configuredRetention()
+  if tiers == nil { return nil, nil }
+  commit, err := env.getCommit(ctx, remote)
+  if err != nil { return nil, err }
+  source := thinnedFrom(commit)
+  if source == nil { return nil, nil }
+  rethinned, err := env.Thin(ctx, source, tiers)
+  if err != nil { return nil, err }
+  if !bytes.Equal(rethinned, remote) {
+    log.Printf("%s doesn't match our own thinning of %s; is the retention policy the same on every peer?",
+               GetShortHexString(remote), GetShortHexString(source))
+    return nil, nil
+  }
+  return source, nil
+}
+
+// Reports whether remote is, or is an ancestor of, the commit that head was
+// thinned from, so that merging it would only bring back what thinning
+// dropped.
+func (env *Env) supersededByThinning(head types.Hash, remote types.Hash) bool {
+  commit, err := env.getCommit(context.Background(), head)
+  if err != nil { return false }
+  source := thinnedFrom(commit)
+  return source != nil && (bytes.Equal(source, remote) || env.DoesADescendFromB(source, remote))
+}
+
+// Finds the merge base of local and remote, given the commit that remote
+// was thinned from, if any.  Peers thinning at different times share only
+// the oldest of their thinned commits, so the histories each side was
+// thinned from, which go back further together, are tried first.
+func (env *Env) mergeBaseAcrossThinning(ctx context.Context, local types.Hash, remote types.Hash,
+                                        remoteSource types.Hash) (types.Hash, error) {
+  locals := []types.Hash{local}
+  commit, err := env.getCommit(ctx, local)
+  if err != nil { return nil, err }
+  if source := thinnedFrom(commit); source != nil {
+    locals = []types.Hash{source, local}
+  }
+  remotes := []types.Hash{remote}
+  if remoteSource != nil {
+    remotes = []types.Hash{remoteSource, remote}
+  }
+  var lastErr error
+  for _, a := range locals {
+    for _, b := range remotes {
+      // What thinning dropped may since have been collected, in which case
+      // the next pair may still do
+      base, err := env.MergeBase(ctx, a, b)
+      if err != nil {
+        lastErr = err
+      } else if base != nil {
+        return base, nil
+      }
+    }
+  }
+  return nil, lastErr
+}
+
+// RetentionConfigured reports whether old history is thinned, and so
+// whether there's garbage worth collecting.
+func (env *Env) RetentionConfigured() bool {
+  return env.configuredRetention() != nil
+}
@@ -0,0 +1,168 @@
+package blob
+
+import (
+  "bytes"
+  "context"
+  "io/ioutil"
+  "os"
+  "path"
+  "testing"
+  "time"
+  "../types"
+)
+
+func TestParseRetention(t *testing.T) {
+  tiers, err := parseRetention("daily 365d, all 24h, hourly 30d")
+  if err != nil { t.Fatal(err) }
+  expected := []retentionTier{
+    {age: 24 * time.Hour, interval: 0},
+    {age: 30 * 24 * time.Hour, interval: time.Hour},
+    {age: 365 * 24 * time.Hour, interval: 24 * time.Hour},
+  }
+  if len(tiers) != len(expected) {
+    t.Fatalf("Expected %v, got %v", expected, tiers)
+  }
+  for i := range expected {
+    if tiers[i] != expected[i] {
+      t.Errorf("Expected %v, got %v", expected[i], tiers[i])
+    }
+  }
+  for _, invalid := range []string{"hourly", "sometimes 30d", "daily 3x"} {
+    if _, err := parseRetention(invalid); err == nil {
+      t.Errorf("Expected %q to be rejected", invalid)
+    }
+  }
+}
+
+func TestThinnedCommits(t *testing.T) {
+  tip := time.Unix(1361048400, 0)
+  tiers := []retentionTier{{age: time.Hour, interval: 0}, {age: 24 * time.Hour, interval: time.Hour}}
+  ages := []time.Duration{
+    0,
+    30 * time.Minute,                 // kept: every commit within the hour
+    2 * time.Hour + 5 * time.Minute,  // kept: the newest in its hour
+    2 * time.Hour + 15 * time.Minute,
+    5 * time.Hour,                    // kept
+    48 * time.Hour,                   // dropped: older than any tier
+  }
+  times := []time.Time{}
+  for _, age := range ages {
+    times = append(times, tip.Add(-age))
+  }
+  keep := thinnedCommits(times, tiers)
+  expected := []bool{true, true, true, false, true, false}
+  for i := range expected {
+    if keep[i] != expected[i] {
+      t.Errorf("Expected keep %v, got %v", expected, keep)
+      break
+    }
+  }
+}
+
+func TestThin(t *testing.T) {
+  // A commit every ten minutes for five hours
+  store := memStorage{}
+  env := &Env{Storage: store}
+  start := time.Unix(1361048400, 0)
+  var tip types.Hash
+  for i := 0; i <= 30; i++ {
+    commit := &types.Commit{
+      Tree: types.Hash{byte(i)},
+      Parents: []types.Hash{},
+      Text: commitText("peer", "peer@example.com", start.Add(time.Duration(i) * 10 * time.Minute), "change\n"),
+    }
+    if tip != nil {
+      commit.Parents = append(commit.Parents, tip)
+    }
+    var err error
+    tip, err = store.Put(types.Blob{Commit: commit})
+    if err != nil { t.Fatal(err) }
+  }
+  tiers := []retentionTier{{age: time.Hour, interval: 0}, {age: 24 * time.Hour, interval: time.Hour}}
+  thinned, err := env.Thin(context.Background(), tip, tiers)
+  if err != nil { t.Fatal(err) }
+  // The last hour's seven commits, and the newest of each of the four
+  // hours before them
+  chain := 0
+  for hash := thinned; hash != nil; chain++ {
+    commit, err := env.getCommit(context.Background(), hash)
+    if err != nil { t.Fatal(err) }
+    if chain == 0 && (!bytes.Equal(commit.Tree, types.Hash{30}) || !bytes.Equal(thinnedFrom(commit), tip)) {
+      t.Errorf("Expected the thinned tip to keep its tree and name %s", GetShortHexString(tip))
+    }
+    hash = nil
+    if len(commit.Parents) > 0 {
+      hash = commit.Parents[0]
+    }
+  }
+  if chain != 11 {
+    t.Errorf("Expected 11 commits after thinning, got %d", chain)
+  }
+  again, err := env.Thin(context.Background(), tip, tiers)
+  if err != nil || !bytes.Equal(again, thinned) {
+    t.Errorf("Expected thinning to be repeatable")
+  }
+  unchanged, err := env.Thin(context.Background(), thinned, tiers)
+  if err != nil || !bytes.Equal(unchanged, thinned) {
+    t.Errorf("Expected nothing more to thin")
+  }
+}
+
+func TestMergeBaseAcrossThinning(t *testing.T) {
+  dir, err := ioutil.TempDir("", "thinning")
+  if err != nil { t.Fatal(err) }
+  defer os.RemoveAll(dir)
+  store := memStorage{}
+  env := &Env{Hub: types.NewHub(), Storage: store, CacheRoot: dir}
+  defer close(env.Hub.Done)
+  graph := loadCommitGraph(path.Join(dir, "commit-graph"), env.readCommitParents)
+  go func() {
+    for {
+      select {
+        case query := <-env.Hub.MergeBaseChannel:
+          base, err := graph.MergeBase(context.Background(), query.CommitA, query.CommitB)
+          query.ResponseChannel <- types.MergeBaseResponse{Base: base, Err: err}
+        case <-env.Hub.Done:
+          return
+      }
+    }
+  }()
+  // A commit every ten minutes for five hours, then one more on one peer
+  start := time.Unix(1361048400, 0)
+  var tip, shared types.Hash
+  for i := 0; i <= 31; i++ {
+    commit := &types.Commit{
+      Tree: types.Hash{byte(i)},
+      Parents: []types.Hash{},
+      Text: commitText("peer", "peer@example.com", start.Add(time.Duration(i) * 10 * time.Minute), "change\n"),
+    }
+    if tip != nil {
+      commit.Parents = append(commit.Parents, tip)
+    }
+    shared = tip
+    tip, err = store.Put(types.Blob{Commit: commit})
+    if err != nil { t.Fatal(err) }
+  }
+  tiers := []retentionTier{{age: time.Hour, interval: 0}, {age: 24 * time.Hour, interval: time.Hour}}
+  // One peer thinned before the other's last commit, which the other
+  // thinned later
+  local, err := env.Thin(context.Background(), shared, tiers)
+  if err != nil { t.Fatal(err) }
+  remote, err := env.Thin(context.Background(), tip, tiers)
+  if err != nil { t.Fatal(err) }
+  cases := []struct {
+    local, remote, remoteSource types.Hash
+  }{
+    {local, tip, nil},
+    {local, remote, tip},
+    {remote, local, shared},
+  }
+  for _, c := range cases {
+    base, err := env.mergeBaseAcrossThinning(context.Background(), c.local, c.remote, c.remoteSource)
+    if err != nil { t.Fatal(err) }
+    if !bytes.Equal(base, shared) {
+      t.Errorf("Expected the merge base of %s and %s to be %s, got %v", GetShortHexString(c.local),
+               GetShortHexString(c.remote), GetShortHexString(shared), base)
+    }
+  }
+}
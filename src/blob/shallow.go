@@ -0,0 +1,139 @@
+package blob
+
+import (
+  "bufio"
+  "context"
+  "encoding/hex"
+  "fmt"
+  "io/ioutil"
+  "log"
+  "os"
+  "path/filepath"
+  "strings"
+  "time"
+  "../types"
+)
+
+// A peer joining a share, or catching up after a long absence, needn't
+// fetch all the history it missed.  With `shallow_depth` in shared.ini, it
+// fetches only the latest that many commits, and with `shallow_days`, only
+// those from the last that many days (along with the first older one, to
+// have somewhere to start from).  Either or both may be set; neither means
+// full history.
+//
+// The commits where fetching stopped are listed in the cache's shallow file,
+// one hash per line, like git's.  Their parents are never asked for, and
+// ancestry checks treat them as roots.
+func (env *Env) configuredShallowPolicy() (int, time.Duration) {
+  depth, err := env.Config.GetInt("main", "shallow_depth")
+  if err != nil || depth < 0 {
+    depth = 0
+  }
+  days, err := env.Config.GetInt("main", "shallow_days")
+  if err != nil || days < 0 {
+    days = 0
+  }
+  return depth, time.Duration(days) * 24 * time.Hour
+}
+
+func (env *Env) shallowPath() string {
+  return filepath.Join(env.CacheRoot, "shallow")
+}
+
+// For callers holding shallowMutex
+func (env *Env) loadShallow() {
+  if env.shallow != nil { return }
+  env.shallow = map[string]bool{}
+  data, err := ioutil.ReadFile(env.shallowPath())
+  if err != nil {
+    if !os.IsNotExist(err) {
+      log.Printf("Error reading shallow boundaries: %s", err)
+    }
+    return
+  }
+  for _, line := range strings.Split(string(data), "\n") {
+    hash, err := hex.DecodeString(line)
+    if line == "" || err != nil { continue }
+    env.shallow[GetHexString(hash)] = true
+  }
+}
+
+// IsShallow reports whether a commit's parents were left out of a shallow
+// fetch.
+func (env *Env) IsShallow(hash types.Hash) bool {
+  env.shallowMutex.Lock()
+  defer env.shallowMutex.Unlock()
+  env.loadShallow()
+  return env.shallow[GetHexString(hash)]
+}
+
+func (env *Env) addShallow(hashes []types.Hash) error {
+  if len(hashes) == 0 { return nil }
+  env.shallowMutex.Lock()
+  defer env.shallowMutex.Unlock()
+  env.loadShallow()
+  err := os.MkdirAll(env.CacheRoot, 0755)
+  if err != nil { return err }
+  file, err := os.OpenFile(env.shallowPath(), os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0644)
+  if err != nil { return err }
+  defer file.Close()
+  writer := bufio.NewWriter(file)
+  for _, hash := range hashes {
+    if env.shallow[GetHexString(hash)] { continue }
+    env.shallow[GetHexString(hash)] = true
+    fmt.Fprintln(writer, hex.EncodeToString(hash))
+  }
+  return writer.Flush()
+}
+
+// FetchShallow fetches the history of tip allowed by the shallow policy and
+// records where it stopped.  Without a policy it does nothing, leaving
+// history to be fetched as it's needed.
+func (env *Env) FetchShallow(ctx context.Context, tip types.Hash) error {
+  depth, since := env.configuredShallowPolicy()
+  if depth == 0 && since == 0 { return nil }
+  var cutoff time.Time
+  if since > 0 {
+    cutoff = time.Now().Add(-since)
+  }
+  boundaries, err := env.fetchShallow(ctx, tip, depth, cutoff)
+  if err != nil { return err }
+  if len(boundaries) > 0 {
+    log.Printf("Fetched shallow history of %s, stopping at %d commits", GetShortHexString(tip), len(boundaries))
+  }
+  return env.addShallow(boundaries)
+}
+
+// Walks back from tip a generation at a time, fetching each commit, and
+// returns the ones beyond which history is cut off: those depth commits
+// from tip (if depth is set), and those from before cutoff (if it is).
+// The walk stops at commits already in the cache, whose history was taken
+// care of when they arrived.
+func (env *Env) fetchShallow(ctx context.Context, tip types.Hash, depth int,
+                             cutoff time.Time) ([]types.Hash, error) {
+  boundaries := []types.Hash{}
+  seen := map[string]bool{GetHexString(tip): true}
+  level := []types.Hash{tip}
+  for distance := 1; len(level) > 0; distance++ {
+    next := []types.Hash{}
+    for _, hash := range level {
+      if env.IsShallow(hash) { continue }
+      commit, err := env.getCommit(ctx, hash)
+      if err != nil { return nil, err }
+      if len(commit.Parents) == 0 { continue }
+      _, when := commitAuthor(commit)
+      if (depth > 0 && distance >= depth) || (!cutoff.IsZero() && when.Before(cutoff)) {
+        boundaries = append(boundaries, hash)
+        continue
+      }
+      for _, parent := range commit.Parents {
+        if !seen[GetHexString(parent)] && !env.Storage.Has(parent) {
+          seen[GetHexString(parent)] = true
+          next = append(next, parent)
+        }
+      }
+    }
+    level = next
+  }
+  return boundaries, nil
+}
@@ -0,0 +1,124 @@
+package blob
+
+import (
+  "context"
+  "crypto/sha1"
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "path"
+  "testing"
+  "time"
+  conf "github.com/tillberg/goconfig"
+  "../types"
+)
+
+// Just enough storage for walking and writing history
+type memStorage map[string]types.Blob
+
+func (store memStorage) Get(hash types.Hash) (types.Blob, error) {
+  blob, present := store[GetHexString(hash)]
+  if !present { return blob, os.ErrNotExist }
+  return blob, nil
+}
+func (store memStorage) Has(hash types.Hash) bool { _, present := store[GetHexString(hash)]; return present }
+func (store memStorage) Put(blob types.Blob) (types.Hash, error) {
+  h := sha1.New()
+  if blob.Commit != nil {
+    fmt.Fprintf(h, "%x %x %q", blob.Commit.Tree, blob.Commit.Parents, blob.Commit.Text)
+  } else if blob.Tree != nil {
+    for _, entry := range blob.Tree.Entries {
+      fmt.Fprintf(h, "%o %q %x\n", entry.Flags, entry.Name, entry.Hash)
+    }
+  } else if blob.File != nil {
+    fmt.Fprintf(h, "file %q", blob.File.Bytes)
+  } else {
+    return nil, errors.New("empty blob")
+  }
+  hash := h.Sum(nil)
+  store[GetHexString(hash)] = blob
+  return hash, nil
+}
+func (store memStorage) Deflate(in []byte) []byte { return in }
+func (store memStorage) Inflate(in []byte) ([]byte, error) { return in, nil }
+func (store memStorage) PutRef(name string, hash types.Hash) error { return errors.New("read-only") }
+func (store memStorage) GetRef(name string) (types.Hash, error) { return nil, nil }
+func (store memStorage) ListRefs() (map[string]types.Hash, error) { return nil, nil }
+func (store memStorage) ListObjects(visit func(hash types.Hash, stored time.Time) error) error { return nil }
+func (store memStorage) Remove(hash types.Hash) error { delete(store, GetHexString(hash)); return nil }
+
+// Answers the env's requests for objects from a peer's storage, copying
+// them into the env's own as they arrive
+func servePeer(env *Env, local memStorage, peer memStorage) {
+  for {
+    select {
+      case request := <-env.Hub.BlobRequestChannel:
+        blob, present := peer[GetHexString(request.Hash)]
+        if present {
+          local[GetHexString(request.Hash)] = blob
+        }
+        request.ResponseChannel <- types.BlobResponse{Hash: request.Hash, Found: present}
+      case <-env.Hub.Done:
+        return
+    }
+  }
+}
+
+func TestFetchShallow(t *testing.T) {
+  dir, err := ioutil.TempDir("", "shallow")
+  if err != nil { t.Fatal(err) }
+  defer os.RemoveAll(dir)
+  // 1 <- 2 <- 3 <- 4 <- 5, a day apart and ending now, of which the peer
+  // still has the latest three
+  now := time.Now()
+  peer := memStorage{}
+  for i := byte(3); i <= 5; i++ {
+    when := now.Add(time.Duration(int(i) - 5) * 24 * time.Hour)
+    peer[GetHexString(types.Hash{i})] = types.Blob{Commit: &types.Commit{
+      Parents: []types.Hash{{i - 1}},
+      Text: commitText("peer", "peer@example.com", when, "change\n"),
+    }}
+  }
+  join := func() (*Env, memStorage) {
+    store := memStorage{}
+    env := &Env{Hub: types.NewHub(), Storage: store, CacheRoot: dir, Config: conf.NewConfigFile()}
+    go servePeer(env, store, peer)
+    return env, store
+  }
+  env, _ := join()
+  defer close(env.Hub.Done)
+  boundaries, err := env.fetchShallow(context.Background(), types.Hash{5}, 2, time.Time{})
+  if err != nil { t.Fatal(err) }
+  if len(boundaries) != 1 || boundaries[0][0] != 4 {
+    t.Fatalf("Expected history to stop at 4, got %v", boundaries)
+  }
+  // History already fetched isn't walked again
+  boundaries, err = env.fetchShallow(context.Background(), types.Hash{5}, 2, time.Time{})
+  if err != nil || len(boundaries) != 0 {
+    t.Fatalf("Expected nothing more to fetch, got %v (%v)", boundaries, err)
+  }
+  env, store := join()
+  defer close(env.Hub.Done)
+  boundaries, err = env.fetchShallow(context.Background(), types.Hash{5}, 0, now.Add(-36 * time.Hour))
+  if err != nil { t.Fatal(err) }
+  if len(boundaries) != 1 || boundaries[0][0] != 3 {
+    t.Fatalf("Expected history to stop at 3, got %v", boundaries)
+  }
+  err = env.addShallow(boundaries)
+  if err != nil { t.Fatal(err) }
+  // Boundaries are read back, and ancestry stops at them without asking
+  // for what's beyond
+  reloaded := &Env{Storage: store, CacheRoot: dir}
+  if !reloaded.IsShallow(types.Hash{3}) || reloaded.IsShallow(types.Hash{4}) {
+    t.Errorf("Expected only 3 to be shallow")
+  }
+  graph := loadCommitGraph(path.Join(dir, "commit-graph"), reloaded.readCommitParents)
+  descends, err := graph.Descends(context.Background(), types.Hash{5}, types.Hash{3})
+  if err != nil || !descends {
+    t.Errorf("Expected 5 to descend from 3: %v", err)
+  }
+  if graph.nodes[GetHexString(types.Hash{3})].generation != 1 {
+    t.Errorf("Expected the boundary to be a root")
+  }
+}
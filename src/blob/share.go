@@ -0,0 +1,121 @@
+package blob
+
+import (
+  "fmt"
+  "log"
+  "path/filepath"
+  "sort"
+  "strings"
+  conf "github.com/tillberg/goconfig"
+)
+
+// A directory kept in sync under a name that every peer agrees on.  Local
+// revisions are committed to Branch, and peers' RemoteBranch is merged in.
+type Share struct {
+  Name         string
+  Root         string
+  Branch       string
+  RemoteBranch string
+  Watcher      string
+}
+
+// Shares are configured in shared.ini with one section each, e.g.
+//
+//   [share:docs]
+//   root = /home/alice/docs
+//   branch = laptop
+//   remote_branch = master
+//
+// `branch` defaults to master and `remote_branch` to the same as `branch`.
+// `watcher` is inotify, scan, or auto (the default), which scans shares on
+// network and FUSE filesystems and watches the rest.
+const shareSectionPrefix = "share:"
+
+// The share used when none are configured
+const DefaultShareName = "default"
+
+// The ref that a branch of a share is stored under in the cache.  The
+// default share's branches keep the bare names they had before there were
+// shares, so that an existing cache carries on where it left off.
+func RefName(share string, branch string) string {
+  if share == DefaultShareName {
+    return branch
+  }
+  return share + "/" + branch
+}
+
+func (share *Share) RefName() string {
+  return RefName(share.Name, share.Branch)
+}
+
+// Where a share keeps its index and trash, apart from the shared objects
+func (share *Share) CachePath(cacheRoot string) string {
+  return filepath.Join(cacheRoot, "shares", share.Name)
+}
+
+// Validate reports what, if anything, is wrong with a share's settings.  An
+// empty Watcher is the same as auto.
+func (share *Share) Validate() error {
+  if share.Name == "" || share.Root == "" {
+    return fmt.Errorf("share %q needs both a name and a root", share.Name)
+  }
+  switch share.Watcher {
+    case "", "auto", "scan", "inotify":
+      return nil
+  }
+  return fmt.Errorf("unrecognized watcher for share %s: %s", share.Name, share.Watcher)
+}
+
+// Reads the shares configured in shared.ini.  With none configured, there is
+// a single share named DefaultShareName at defaultRoot, following master.
+func ConfiguredShares(config *conf.ConfigFile, defaultRoot string) ([]*Share, error) {
+  getOption := func(section string, option string, fallback string) string {
+    value, err := config.GetString(section, option)
+    if err != nil || value == "" {
+      return fallback
+    }
+    return value
+  }
+  shares := []*Share{}
+  sections := config.GetSections()
+  sort.Strings(sections)
+  for _, section := range sections {
+    if !strings.HasPrefix(section, shareSectionPrefix) { continue }
+    share := &Share{Name: strings.TrimPrefix(section, shareSectionPrefix)}
+    share.Root = getOption(section, "root", "")
+    share.Branch = getOption(section, "branch", "master")
+    share.RemoteBranch = getOption(section, "remote_branch", share.Branch)
+    share.Watcher = getOption(section, "watcher", "auto")
+    err := share.Validate()
+    if err != nil { return nil, err }
+    shares = append(shares, share)
+  }
+  if len(shares) == 0 {
+    shares = append(shares, &Share{
+      Name: DefaultShareName,
+      Root: defaultRoot,
+      Branch: "master",
+      RemoteBranch: "master",
+      Watcher: getOption("main", "watcher", "auto"),
+    })
+    err := shares[0].Validate()
+    if err != nil { return nil, err }
+  }
+  return shares, nil
+}
+
+// Reports whether the share should be scanned for changes rather than
+// watched with inotify.  The share is assumed to be valid.
+func (share *Share) scanned() bool {
+  switch share.Watcher {
+    case "scan":
+      return true
+    case "inotify":
+      return false
+  }
+  kind, unwatchable := unwatchableFilesystem(share.Root)
+  if unwatchable {
+    log.Printf("%s is on %s, which doesn't report changes; scanning it instead", share.Root, kind)
+  }
+  return unwatchable
+}
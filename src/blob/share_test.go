@@ -0,0 +1,31 @@
+package blob
+
+import (
+  "testing"
+  conf "github.com/tillberg/goconfig"
+)
+
+func TestConfiguredShares(t *testing.T) {
+  config := conf.NewConfigFile()
+  shares, err := ConfiguredShares(config, "/tmp/watched")
+  if err != nil { t.Fatal(err) }
+  if len(shares) != 1 || shares[0].Name != DefaultShareName || shares[0].Root != "/tmp/watched" {
+    t.Errorf("Expected just the default share, got %v", shares)
+  }
+  config.AddOption("share:docs", "root", "/tmp/docs")
+  config.AddOption("share:docs", "branch", "laptop")
+  shares, err = ConfiguredShares(config, "/tmp/watched")
+  if err != nil { t.Fatal(err) }
+  if len(shares) != 1 || shares[0].Name != "docs" || shares[0].RemoteBranch != "laptop" {
+    t.Errorf("Expected the docs share following laptop, got %v", shares)
+  }
+  config.AddOption("share:docs", "watcher", "fanotify")
+  if _, err := ConfiguredShares(config, "/tmp/watched"); err == nil {
+    t.Errorf("Expected an unrecognized watcher to be an error")
+  }
+  config.AddOption("share:docs", "watcher", "scan")
+  config.AddOption("share:music", "watcher", "scan")
+  if _, err := ConfiguredShares(config, "/tmp/watched"); err == nil {
+    t.Errorf("Expected a share without a root to be an error")
+  }
+}
@@ -0,0 +1,117 @@
+package blob
+
+import (
+  "context"
+  "fmt"
+  "os"
+  "path"
+  "sort"
+  "strings"
+  "../storage"
+  "../types"
+)
+
+const (
+  modeTree = 040000
+  modeFile = 0100644
+  modeExecutable = 0100755
+  modeSymlink = 0120000
+)
+
+// Like git, only the owner's execute bit is recorded; everything else about
+// a file's permissions is left to the receiving end.
+func entryFlags(info os.FileInfo) uint32 {
+  if info.Mode() & os.ModeSymlink != 0 {
+    return modeSymlink
+  } else if info.Mode() & 0100 != 0 {
+    return modeExecutable
+  }
+  return modeFile
+}
+
+type treeNode struct {
+  entries []*types.TreeEntry
+  subtrees map[string]*treeNode
+}
+
+func newTreeNode() *treeNode {
+  return &treeNode{entries: []*types.TreeEntry{}, subtrees: map[string]*treeNode{}}
+}
+
+// Git orders tree entries by name, comparing subtrees as though their names
+// had a trailing slash.
+type byGitName []*types.TreeEntry
+
+func gitSortName(entry *types.TreeEntry) string {
+  if entry.Flags == modeTree {
+    return entry.Name + "/"
+  }
+  return entry.Name
+}
+
+func (s byGitName) Len() int           { return len(s) }
+func (s byGitName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byGitName) Less(i, j int) bool { return gitSortName(s[i]) < gitSortName(s[j]) }
+
+func (node *treeNode) put(store storage.Storage) (types.Hash, error) {
+  tree := &types.Tree{Entries: append([]*types.TreeEntry{}, node.entries...)}
+  for name, subtree := range node.subtrees {
+    hash, err := subtree.put(store)
+    if err != nil { return nil, err }
+    tree.Entries = append(tree.Entries, &types.TreeEntry{Hash: hash, Name: name, Flags: modeTree})
+  }
+  sort.Sort(byGitName(tree.Entries))
+  return store.Put(types.Blob{Tree: tree})
+}
+
+// PutTree stores a flat map of files, keyed by slash-separated path relative
+// to the root of the share, as a hierarchy of nested trees.  It returns the
+// hash of the root tree.
+func (env *Env) PutTree(children map[string]*types.TreeEntry) (types.Hash, error) {
+  root := newTreeNode()
+  for relPath, entry := range children {
+    node := root
+    dirs := strings.Split(path.Dir(relPath), "/")
+    for _, dir := range dirs {
+      if dir == "." { continue }
+      if node.subtrees[dir] == nil {
+        node.subtrees[dir] = newTreeNode()
+      }
+      node = node.subtrees[dir]
+    }
+    node.entries = append(node.entries, &types.TreeEntry{
+      Hash: entry.Hash,
+      Name: path.Base(relPath),
+      Flags: entry.Flags,
+    })
+  }
+  return root.put(env.Storage)
+}
+
+// FlattenTree is the inverse of PutTree: it walks the tree with the given
+// hash and returns every non-tree entry keyed by its path relative to the
+// root.
+func (env *Env) FlattenTree(ctx context.Context, hash types.Hash) (map[string]*types.TreeEntry, error) {
+  children := map[string]*types.TreeEntry{}
+  err := env.flattenTreeInto(ctx, children, hash, "")
+  return children, err
+}
+
+func (env *Env) flattenTreeInto(ctx context.Context, children map[string]*types.TreeEntry, hash types.Hash,
+                     prefix string) error {
+  treeBlob, err := env.GetBlob(ctx, hash)
+  if err != nil { return err }
+  if treeBlob.Tree == nil {
+    return fmt.Errorf("expected tree %s but got %v instead", GetShortHexString(hash), treeBlob)
+  }
+  for _, entry := range treeBlob.Tree.Entries {
+    relPath := path.Join(prefix, entry.Name)
+    if entry.Flags == modeTree {
+      err = env.flattenTreeInto(ctx, children, entry.Hash, relPath)
+      if err != nil { return err }
+    } else {
+      children[relPath] = entry
+    }
+  }
+  return nil
+}
@@ -0,0 +1,297 @@
+package blob
+
+import (
+  "context"
+  "io/ioutil"
+  "log"
+  "os"
+  "path"
+  "path/filepath"
+  "strings"
+  "syscall"
+  "time"
+  "../ignore"
+  "../types"
+)
+
+// Reports whether a symlink at linkPath pointing at target would resolve to
+// somewhere inside rootPath.  Links that escape the share are never synced,
+// in either direction.
+func isLinkInsideRoot(rootPath string, linkPath string, target string) bool {
+  if !path.IsAbs(target) {
+    target = path.Join(path.Dir(linkPath), target)
+  }
+  absRoot, err := filepath.Abs(rootPath)
+  if err != nil { return false }
+  absTarget, err := filepath.Abs(target)
+  if err != nil { return false }
+  rel, err := filepath.Rel(absRoot, absTarget)
+  return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// Remote files are written to a temporary file alongside their destination
+// and renamed into place, so nobody sees them half-written.  WatchTree skips
+// anything with this prefix.
+const tempPrefix = ".shared-tmp-"
+
+// What we last wrote to a path while unpacking, so that the watcher can tell
+// its own writes apart from local edits when the events come back around.
+type ownWrite struct {
+  hash    types.Hash
+  size    int64
+  modTime time.Time
+}
+
+func (env *Env) recordOwnWrite(filePath string, hash types.Hash) {
+  statbuf, err := os.Lstat(filePath)
+  if err != nil { return }
+  env.ownWritesMutex.Lock()
+  defer env.ownWritesMutex.Unlock()
+  env.ownWrites[path.Clean(filePath)] = ownWrite{hash: hash, size: statbuf.Size(), modTime: statbuf.ModTime()}
+}
+
+func (env *Env) forgetOwnWrite(filePath string) {
+  env.ownWritesMutex.Lock()
+  defer env.ownWritesMutex.Unlock()
+  delete(env.ownWrites, path.Clean(filePath))
+}
+
+// Returns the hash we unpacked to the file if it still has the size and
+// mtime we left it with, or nil.  Since a same-size rewrite within the
+// mtime's granularity looks the same, the caller must still compare the
+// file's contents against that hash.  Once the file has been changed by
+// someone else, it is forgotten.
+func (env *Env) expectedOwnWrite(filePath string, statbuf os.FileInfo) types.Hash {
+  env.ownWritesMutex.Lock()
+  defer env.ownWritesMutex.Unlock()
+  key := path.Clean(filePath)
+  write, present := env.ownWrites[key]
+  if !present { return nil }
+  if write.size == statbuf.Size() && write.modTime.Equal(statbuf.ModTime()) {
+    return write.hash
+  }
+  delete(env.ownWrites, key)
+  return nil
+}
+
+// Writes a single tree entry out to the working directory, recreating its
+// mode or, for symlinks, the link itself.
+func (env *Env) unpackEntry(rootPath string, name string, entry *types.TreeEntry, file *types.File) error {
+  filePath := path.Join(rootPath, name)
+  err := os.MkdirAll(path.Dir(filePath), 0755)
+  if err != nil { return err }
+  if entry.Flags == modeSymlink {
+    target := string(file.Bytes)
+    if !isLinkInsideRoot(rootPath, filePath, target) {
+      log.Printf("Refusing to unpack symlink %s -> %s, which points outside the share", name, target)
+      return nil
+    }
+    existing, err := os.Readlink(filePath)
+    if err == nil && existing == target {
+      return nil
+    }
+  }
+  tempFile, err := ioutil.TempFile(path.Dir(filePath), tempPrefix)
+  if err != nil { return err }
+  tempPath := tempFile.Name()
+  if entry.Flags == modeSymlink {
+    // We only wanted a unique name
+    tempFile.Close()
+    os.Remove(tempPath)
+    err = os.Symlink(string(file.Bytes), tempPath)
+  } else {
+    perm := os.FileMode(0644)
+    if entry.Flags == modeExecutable {
+      perm = 0755
+    }
+    _, err = tempFile.Write(file.Bytes)
+    closeErr := tempFile.Close()
+    if err == nil { err = closeErr }
+    if err == nil { err = os.Chmod(tempPath, perm) }
+  }
+  if err == nil {
+    // This replaces rather than follows a symlink already at filePath
+    err = os.Rename(tempPath, filePath)
+  }
+  if err != nil {
+    os.Remove(tempPath)
+    return err
+  }
+  env.recordOwnWrite(filePath, entry.Hash)
+  return nil
+}
+
+// With `soft_delete = true` in shared.ini, files removed by a remote peer are
+// moved into the trash in the cache directory rather than deleted outright.
+func (env *Env) configuredSoftDelete() bool {
+  softDelete, err := env.Config.GetBool("main", "soft_delete")
+  return err == nil && softDelete
+}
+
+// Renames a file or symlink, falling back to copying it and removing the
+// original when they're on different filesystems, as the share and the
+// cache directory may well be.
+func moveFile(fromPath string, toPath string) error {
+  err := os.Rename(fromPath, toPath)
+  linkErr, isLinkErr := err.(*os.LinkError)
+  if !isLinkErr || linkErr.Err != syscall.EXDEV {
+    return err
+  }
+  statbuf, err := os.Lstat(fromPath)
+  if err != nil { return err }
+  if statbuf.Mode() & os.ModeSymlink != 0 {
+    target, err := os.Readlink(fromPath)
+    if err == nil { err = os.Symlink(target, toPath) }
+    if err != nil { return err }
+  } else {
+    data, err := ioutil.ReadFile(fromPath)
+    if err == nil { err = ioutil.WriteFile(toPath, data, statbuf.Mode().Perm()) }
+    if err != nil {
+      os.Remove(toPath)
+      return err
+    }
+  }
+  return os.Remove(fromPath)
+}
+
+// Removes a single file from the working directory, along with any parent
+// directories that are left empty.  If trashPath is set, the file is moved
+// to the same relative path beneath it instead.
+func (env *Env) removeEntry(rootPath string, name string, trashPath string) error {
+  filePath := path.Join(rootPath, name)
+  env.forgetOwnWrite(filePath)
+  var err error
+  if trashPath != "" {
+    trashFilePath := path.Join(trashPath, name)
+    err = os.MkdirAll(path.Dir(trashFilePath), 0755)
+    if err != nil { return err }
+    err = moveFile(filePath, trashFilePath)
+  } else {
+    err = os.Remove(filePath)
+  }
+  if err != nil && !os.IsNotExist(err) {
+    return err
+  }
+  root := path.Clean(rootPath)
+  for dir := path.Dir(filePath); dir != root && dir != "." && dir != "/"; dir = path.Dir(dir) {
+    if os.Remove(dir) != nil {
+      // Not empty, so neither are any of its parents
+      break
+    }
+  }
+  return nil
+}
+
+// Reads and stores whatever is at filePath now, unless the index vouches for
+// it, returning nil if there's no file there.
+func (env *Env) localEntry(index *Index, filePath string) (*types.TreeEntry, error) {
+  statbuf, err := os.Lstat(filePath)
+  if err != nil || statbuf.IsDir() {
+    return nil, nil
+  }
+  flags := entryFlags(statbuf)
+  hash, indexed := index.Lookup(filePath, statbuf)
+  if !indexed {
+    var data []byte
+    if flags == modeSymlink {
+      var target string
+      target, err = os.Readlink(filePath)
+      data = []byte(target)
+    } else {
+      data, err = ioutil.ReadFile(filePath)
+    }
+    if err != nil { return nil, err }
+    hash, err = env.Storage.Put(types.Blob{File: &types.File{Bytes: data}})
+    if err != nil { return nil, err }
+  }
+  return &types.TreeEntry{Hash: hash, Flags: flags}, nil
+}
+
+// Brings a share's working directory from one flattened tree to another,
+// touching only the paths that differ.  Removals go first so that a file
+// replaced by a directory of the same name (or vice versa) is out of the way,
+// except for ignore files, which go before them so that anything they now
+// ignore is left in place: a path untracked elsewhere isn't deleted here.
+// Local edits that are still settling, and so aren't in before yet, are
+// moved aside to conflict copies rather than overwritten or removed.
+func (env *Env) unpackTreeDiff(ctx context.Context, share *Share, rules *ignore.Rules, index *Index,
+                    before map[string]*types.TreeEntry, after map[string]*types.TreeEntry) []types.Conflict {
+  rootPath := share.Root
+  trashPath := ""
+  if env.configuredSoftDelete() {
+    trashPath = path.Join(share.CachePath(env.CacheRoot), "trash", time.Now().Format("20060102-150405"))
+  }
+  localSide := mergeSide{when: time.Now()}
+  localSide.peer, _ = os.Hostname()
+  conflicts := []types.Conflict{}
+  // Reports whether it's safe to replace or remove name
+  keepLocalEdit := func(name string) bool {
+    local, err := env.localEntry(index, path.Join(rootPath, name))
+    if err != nil {
+      log.Printf("Leaving %s alone, since it can't be read: %s", name, err)
+      return false
+    }
+    if local == nil || sameEntry(local, before[name]) || sameEntry(local, after[name]) {
+      return true
+    }
+    copyPath := conflictPath(name, localSide)
+    err = os.Rename(path.Join(rootPath, name), path.Join(rootPath, copyPath))
+    if err != nil {
+      log.Printf("Leaving %s alone, since its local changes can't be moved aside: %s", name, err)
+      return false
+    }
+    log.Printf("Conflict in %s, which changed locally; keeping the local version as %s", name, copyPath)
+    conflicts = append(conflicts, types.Conflict{Path: name, CopyPath: copyPath, Peer: localSide.peer})
+    return true
+  }
+  unpack := func(name string, entry *types.TreeEntry) bool {
+    if !keepLocalEdit(name) {
+      return false
+    }
+    fileblob, err := env.GetBlob(ctx, entry.Hash)
+    if err == nil {
+      err = env.unpackEntry(rootPath, name, entry, fileblob.File)
+    }
+    if err != nil {
+      log.Printf("Error unpacking %s: %s", name, err)
+      return false
+    }
+    statbuf, err := os.Lstat(path.Join(rootPath, name))
+    if err == nil {
+      index.Update(path.Join(rootPath, name), statbuf, entry.Hash)
+    }
+    log.Printf("Unpacked %s, %s", name, GetShortHexString(entry.Hash))
+    return true
+  }
+  for name, entry := range after {
+    if path.Base(name) != ignore.FileName || sameEntry(before[name], entry) { continue }
+    if unpack(name, entry) {
+      loadIgnoreFile(rules, rootPath, path.Dir(path.Join(rootPath, name)))
+    }
+  }
+  for name := range before {
+    if after[name] != nil { continue }
+    if rules.Ignored(name, false) {
+      log.Printf("Leaving %s in place, since it is ignored", name)
+      index.Forget(path.Join(rootPath, name))
+      continue
+    }
+    if !keepLocalEdit(name) { continue }
+    err := env.removeEntry(rootPath, name, trashPath)
+    if err != nil {
+      log.Printf("Error removing %s: %s", name, err)
+      continue
+    }
+    index.Remove(path.Join(rootPath, name))
+    if trashPath != "" {
+      log.Printf("Moved %s to the trash", name)
+    } else {
+      log.Printf("Deleted %s", name)
+    }
+  }
+  for name, entry := range after {
+    if path.Base(name) == ignore.FileName || sameEntry(before[name], entry) { continue }
+    unpack(name, entry)
+  }
+  return conflicts
+}
@@ -0,0 +1,187 @@
+package blob
+
+import (
+  "bytes"
+  "context"
+  "io/ioutil"
+  "os"
+  "path"
+  "testing"
+  "time"
+  conf "github.com/tillberg/goconfig"
+  "../ignore"
+  "../types"
+)
+
+func TestUnpackEntry(t *testing.T) {
+  root, err := ioutil.TempDir("", "shared-unpack")
+  if err != nil { t.Fatal(err) }
+  defer os.RemoveAll(root)
+  env := NewEnv(types.NewHub(), nil, "", nil)
+  script := &types.TreeEntry{Hash: types.Hash{1}, Flags: modeExecutable}
+  err = env.unpackEntry(root, "a/b/script.sh", script, &types.File{Bytes: []byte("#!/bin/sh\n")})
+  if err != nil { t.Fatal(err) }
+  statbuf, err := os.Lstat(path.Join(root, "a/b/script.sh"))
+  if err != nil { t.Fatal(err) }
+  if statbuf.Mode().Perm() != 0755 {
+    t.Errorf("Expected mode 0755, got %o", statbuf.Mode().Perm())
+  }
+  if !bytes.Equal(env.expectedOwnWrite(path.Join(root, "a/b/script.sh"), statbuf), script.Hash) {
+    t.Errorf("Unpacked file should be recognized as our own write")
+  }
+  files, _ := ioutil.ReadDir(path.Join(root, "a/b"))
+  if len(files) != 1 {
+    t.Errorf("Expected no temporary files to be left behind, found %d files", len(files))
+  }
+
+  link := &types.TreeEntry{Hash: types.Hash{2}, Flags: modeSymlink}
+  err = env.unpackEntry(root, "a/link", link, &types.File{Bytes: []byte("b/script.sh")})
+  if err != nil { t.Fatal(err) }
+  target, err := os.Readlink(path.Join(root, "a/link"))
+  if err != nil || target != "b/script.sh" {
+    t.Errorf("Expected a symlink to b/script.sh, got %s (%v)", target, err)
+  }
+  err = env.unpackEntry(root, "escape", link, &types.File{Bytes: []byte("../../etc/passwd")})
+  if err != nil { t.Fatal(err) }
+  _, err = os.Lstat(path.Join(root, "escape"))
+  if !os.IsNotExist(err) {
+    t.Errorf("Symlink pointing outside the share should have been refused")
+  }
+
+  // A local edit afterwards is no longer ours
+  time.Sleep(10 * time.Millisecond)
+  ioutil.WriteFile(path.Join(root, "a/b/script.sh"), []byte("#!/bin/bash\n"), 0755)
+  statbuf, _ = os.Lstat(path.Join(root, "a/b/script.sh"))
+  if env.expectedOwnWrite(path.Join(root, "a/b/script.sh"), statbuf) != nil {
+    t.Errorf("Locally modified file should not be recognized as our own write")
+  }
+}
+
+func TestRemoveEntry(t *testing.T) {
+  root, err := ioutil.TempDir("", "shared-unpack")
+  if err != nil { t.Fatal(err) }
+  defer os.RemoveAll(root)
+  env := NewEnv(types.NewHub(), nil, "", nil)
+  entry := &types.TreeEntry{Hash: types.Hash{1}, Flags: modeFile}
+  env.unpackEntry(root, "a/b/file", entry, &types.File{Bytes: []byte("hello")})
+  env.unpackEntry(root, "a/other", entry, &types.File{Bytes: []byte("hello")})
+  trash := path.Join(root, ".trash")
+  err = env.removeEntry(root, "a/b/file", trash)
+  if err != nil { t.Fatal(err) }
+  _, err = os.Lstat(path.Join(root, "a/b"))
+  if !os.IsNotExist(err) {
+    t.Errorf("Empty directory should have been removed")
+  }
+  bytes, err := ioutil.ReadFile(path.Join(trash, "a/b/file"))
+  if err != nil || string(bytes) != "hello" {
+    t.Errorf("Removed file should have been moved to the trash")
+  }
+  err = env.removeEntry(root, "a/other", "")
+  if err != nil { t.Fatal(err) }
+  _, err = os.Lstat(path.Join(root, "a"))
+  if !os.IsNotExist(err) {
+    t.Errorf("Empty directory should have been removed")
+  }
+  _, err = os.Lstat(root)
+  if err != nil {
+    t.Errorf("The root itself should never be removed")
+  }
+}
+
+func TestUnpackTreeDiffLeavesIgnoredPaths(t *testing.T) {
+  root, err := ioutil.TempDir("", "shared-unpack")
+  if err != nil { t.Fatal(err) }
+  defer os.RemoveAll(root)
+  store := memStorage{}
+  env := NewEnv(types.NewHub(), store, root, conf.NewConfigFile())
+  share := &Share{Name: "test", Root: path.Join(root, "share")}
+  index := LoadIndex(path.Join(root, "index"), share.Root)
+  fileHash, _ := store.Put(types.Blob{File: &types.File{Bytes: []byte("hello")}})
+  ignoreHash, _ := store.Put(types.Blob{File: &types.File{Bytes: []byte("build/\n")}})
+  file := &types.TreeEntry{Hash: fileHash, Flags: modeFile}
+  before := map[string]*types.TreeEntry{"build/out": file, "removed": file}
+  for name, entry := range before {
+    env.unpackEntry(share.Root, name, entry, &types.File{Bytes: []byte("hello")})
+  }
+  // Whoever removed build/out did so by ignoring it
+  after := map[string]*types.TreeEntry{ignore.FileName: {Hash: ignoreHash, Flags: modeFile}}
+  rules := ignore.New(nil)
+  env.unpackTreeDiff(context.Background(), share, rules, index, before, after)
+  if _, err := os.Lstat(path.Join(share.Root, "build/out")); err != nil {
+    t.Errorf("Ignored file should have been left in place: %v", err)
+  }
+  if _, err := os.Lstat(path.Join(share.Root, "removed")); !os.IsNotExist(err) {
+    t.Errorf("Removed file should have been deleted")
+  }
+  if _, err := os.Lstat(path.Join(share.Root, ignore.FileName)); err != nil {
+    t.Errorf("Ignore file should have been unpacked: %v", err)
+  }
+}
+
+func TestMoveFileAcrossFilesystems(t *testing.T) {
+  from, err := ioutil.TempDir("/dev/shm", "shared-unpack")
+  if err != nil { t.Skip("No /dev/shm to move from") }
+  defer os.RemoveAll(from)
+  to, err := ioutil.TempDir("", "shared-unpack")
+  if err != nil { t.Fatal(err) }
+  defer os.RemoveAll(to)
+  ioutil.WriteFile(path.Join(from, "file"), []byte("hello"), 0755)
+  os.Symlink("file", path.Join(from, "link"))
+  for _, name := range []string{"file", "link"} {
+    err = moveFile(path.Join(from, name), path.Join(to, name))
+    if err != nil { t.Fatal(err) }
+    if _, err := os.Lstat(path.Join(from, name)); !os.IsNotExist(err) {
+      t.Errorf("%s should have been removed from where it was", name)
+    }
+  }
+  statbuf, err := os.Lstat(path.Join(to, "file"))
+  if err != nil || statbuf.Mode().Perm() != 0755 {
+    t.Errorf("Expected the file to keep its mode, got %v (%v)", statbuf, err)
+  }
+  target, err := os.Readlink(path.Join(to, "link"))
+  if err != nil || target != "file" {
+    t.Errorf("Expected the symlink to be moved, got %s (%v)", target, err)
+  }
+}
+
+func TestUnpackTreeDiffKeepsLocalEdits(t *testing.T) {
+  root, err := ioutil.TempDir("", "shared-unpack")
+  if err != nil { t.Fatal(err) }
+  defer os.RemoveAll(root)
+  store := memStorage{}
+  env := NewEnv(types.NewHub(), store, root, conf.NewConfigFile())
+  share := &Share{Name: "test", Root: path.Join(root, "share")}
+  index := LoadIndex(path.Join(root, "index"), share.Root)
+  oldHash, _ := store.Put(types.Blob{File: &types.File{Bytes: []byte("old")}})
+  newHash, _ := store.Put(types.Blob{File: &types.File{Bytes: []byte("new")}})
+  oldEntry := &types.TreeEntry{Hash: oldHash, Flags: modeFile}
+  newEntry := &types.TreeEntry{Hash: newHash, Flags: modeFile}
+  before := map[string]*types.TreeEntry{"edited": oldEntry, "removed": oldEntry, "untouched": oldEntry}
+  for name, entry := range before {
+    env.unpackEntry(share.Root, name, entry, &types.File{Bytes: []byte("old")})
+  }
+  // Edited locally, but not yet settled into the tree
+  ioutil.WriteFile(path.Join(share.Root, "edited"), []byte("local"), 0644)
+  ioutil.WriteFile(path.Join(share.Root, "removed"), []byte("local"), 0644)
+  ioutil.WriteFile(path.Join(share.Root, "added"), []byte("local"), 0644)
+  after := map[string]*types.TreeEntry{"edited": newEntry, "added": newEntry, "untouched": newEntry}
+  conflicts := env.unpackTreeDiff(context.Background(), share, ignore.New(nil), index, before, after)
+  if len(conflicts) != 3 {
+    t.Errorf("Expected three conflicts, got %v", conflicts)
+  }
+  for _, conflict := range conflicts {
+    data, err := ioutil.ReadFile(path.Join(share.Root, conflict.CopyPath))
+    if err != nil || string(data) != "local" {
+      t.Errorf("Expected the local version of %s to be kept as a conflict copy", conflict.Path)
+    }
+  }
+  for name, expected := range map[string]string{"edited": "new", "added": "new", "untouched": "new"} {
+    data, err := ioutil.ReadFile(path.Join(share.Root, name))
+    if err != nil || string(data) != expected {
+      t.Errorf("Expected %s to hold %q, got %q (%v)", name, expected, data, err)
+    }
+  }
+  if _, err := os.Lstat(path.Join(share.Root, "removed")); !os.IsNotExist(err) {
+    t.Errorf("Removed file should be gone from its original path")
+  }
+}
@@ -0,0 +1,179 @@
+package ignore
+
+import (
+  "bytes"
+  "path"
+  "regexp"
+  "strings"
+  "sync"
+)
+
+// The name of the per-directory ignore files, which use .gitignore syntax.
+const FileName = ".sharedignore"
+
+type pattern struct {
+  regexp   *regexp.Regexp
+  negate   bool
+  dirOnly  bool
+}
+
+// Rules holds the global ignore patterns along with those loaded from every
+// ignore file in the share.  It is safe for concurrent use.
+type Rules struct {
+  mutex   sync.Mutex
+  global  []*pattern
+  files   map[string][]*pattern // keyed by the directory holding the file
+}
+
+func New(globalPatterns []string) *Rules {
+  rules := &Rules{global: []*pattern{}, files: map[string][]*pattern{}}
+  for _, line := range globalPatterns {
+    p := parsePattern(line)
+    if p != nil {
+      rules.global = append(rules.global, p)
+    }
+  }
+  return rules
+}
+
+// Load replaces the rules from the ignore file in dir, a slash-separated path
+// relative to the root of the share ("" for the root itself).
+func (r *Rules) Load(dir string, data []byte) {
+  patterns := []*pattern{}
+  for _, line := range strings.Split(string(bytes.Replace(data, []byte("\r"), []byte{}, -1)), "\n") {
+    p := parsePattern(line)
+    if p != nil {
+      patterns = append(patterns, p)
+    }
+  }
+  r.mutex.Lock()
+  defer r.mutex.Unlock()
+  r.files[cleanDir(dir)] = patterns
+}
+
+// Remove forgets the rules from the ignore file in dir.
+func (r *Rules) Remove(dir string) {
+  r.mutex.Lock()
+  defer r.mutex.Unlock()
+  delete(r.files, cleanDir(dir))
+}
+
+// Ignored reports whether relPath should be left out of the share.  As with
+// git, nothing beneath an ignored directory can be re-included.
+func (r *Rules) Ignored(relPath string, isDir bool) bool {
+  r.mutex.Lock()
+  defer r.mutex.Unlock()
+  parts := strings.Split(relPath, "/")
+  for i := 1; i < len(parts); i++ {
+    if r.matches(strings.Join(parts[:i], "/"), true) {
+      return true
+    }
+  }
+  return r.matches(relPath, isDir)
+}
+
+// Later patterns take precedence over earlier ones, and patterns from deeper
+// ignore files take precedence over those from shallower ones.
+func (r *Rules) matches(relPath string, isDir bool) bool {
+  ignored := false
+  apply := func(patterns []*pattern, subPath string) {
+    for _, p := range patterns {
+      if (!p.dirOnly || isDir) && p.regexp.MatchString(subPath) {
+        ignored = !p.negate
+      }
+    }
+  }
+  apply(r.global, relPath)
+  apply(r.files[""], relPath)
+  parts := strings.Split(relPath, "/")
+  for i := 1; i < len(parts); i++ {
+    dir := strings.Join(parts[:i], "/")
+    if r.files[dir] != nil {
+      apply(r.files[dir], strings.Join(parts[i:], "/"))
+    }
+  }
+  return ignored
+}
+
+func cleanDir(dir string) string {
+  dir = path.Clean(dir)
+  if dir == "." || dir == "/" {
+    return ""
+  }
+  return strings.TrimPrefix(dir, "/")
+}
+
+func parsePattern(line string) *pattern {
+  // Trailing spaces are ignored unless escaped with a backslash
+  for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+    line = line[:len(line) - 1]
+  }
+  if line == "" || strings.HasPrefix(line, "#") {
+    return nil
+  }
+  p := &pattern{}
+  if strings.HasPrefix(line, "!") {
+    p.negate = true
+    line = line[1:]
+  } else if strings.HasPrefix(line, "\\#") || strings.HasPrefix(line, "\\!") {
+    line = line[1:]
+  }
+  if strings.HasSuffix(line, "/") {
+    p.dirOnly = true
+    line = strings.TrimRight(line, "/")
+  }
+  if line == "" {
+    return nil
+  }
+  // A slash anywhere but the end anchors the pattern to the directory of
+  // the ignore file; otherwise it may match at any depth.
+  anchored := strings.Contains(line, "/")
+  line = strings.TrimPrefix(line, "/")
+  expr := globToRegexp(line)
+  if !anchored {
+    expr = "(?:.*/)?" + expr
+  }
+  compiled, err := regexp.Compile("^" + expr + "$")
+  if err != nil {
+    return nil
+  }
+  p.regexp = compiled
+  return p
+}
+
+func globToRegexp(glob string) string {
+  var buffer bytes.Buffer
+  for i := 0; i < len(glob); i++ {
+    c := glob[i]
+    switch {
+      case strings.HasPrefix(glob[i:], "**/") && (i == 0 || glob[i - 1] == '/'):
+        buffer.WriteString("(?:.*/)?")
+        i += 2
+      case glob[i:] == "**" && (i == 0 || glob[i - 1] == '/'):
+        buffer.WriteString(".*")
+        i++
+      case c == '*':
+        buffer.WriteString("[^/]*")
+      case c == '?':
+        buffer.WriteString("[^/]")
+      case c == '[':
+        end := strings.Index(glob[i + 1:], "]")
+        if end < 0 {
+          buffer.WriteString(regexp.QuoteMeta("["))
+          continue
+        }
+        class := glob[i + 1:i + 1 + end]
+        if strings.HasPrefix(class, "!") {
+          class = "^" + class[1:]
+        }
+        buffer.WriteString("[" + strings.Replace(class, "\\", "\\\\", -1) + "]")
+        i += end + 1
+      case c == '\\' && i + 1 < len(glob):
+        i++
+        buffer.WriteString(regexp.QuoteMeta(glob[i:i + 1]))
+      default:
+        buffer.WriteString(regexp.QuoteMeta(glob[i:i + 1]))
+    }
+  }
+  return buffer.String()
+}
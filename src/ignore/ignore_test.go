@@ -0,0 +1,67 @@
+package ignore
+
+import (
+  "testing"
+)
+
+func exampleRules() *Rules {
+  rules := New([]string{"*.swp", ".DS_Store"})
+  rules.Load("", []byte(
+    "# build outputs\n" +
+    "node_modules/\n" +
+    "/build\n" +
+    "*.log\n" +
+    "!important.log\n" +
+    "docs/**/*.pdf\n" +
+    "tmp[0-9]\n"))
+  rules.Load("src", []byte("generated.go\n!keep.swp\n"))
+  return rules
+}
+
+func TestIgnored(t *testing.T) {
+  rules := exampleRules()
+  cases := []struct {
+    path     string
+    isDir    bool
+    expected bool
+  }{
+    {"README", false, false},
+    {".foo.swp", false, true},
+    {"a/b/.DS_Store", false, true},
+    {"node_modules", true, true},
+    {"node_modules", false, false},
+    {"a/node_modules/left-pad/index.js", false, true},
+    {"build", true, true},
+    {"build/out.o", false, true},
+    {"src/build", true, false},
+    {"server.log", false, true},
+    {"logs/server.log", false, true},
+    {"important.log", false, false},
+    {"docs/a.pdf", false, true},
+    {"docs/a/b/c.pdf", false, true},
+    {"a/docs/c.pdf", false, false},
+    {"tmp1", false, true},
+    {"tmpa", false, false},
+    {"src/generated.go", false, true},
+    {"src/pkg/generated.go", false, true},
+    {"generated.go", false, false},
+    {"src/keep.swp", false, false},
+    {"keep.swp", false, true},
+  }
+  for _, c := range cases {
+    if rules.Ignored(c.path, c.isDir) != c.expected {
+      t.Errorf("Ignored(%q, %v) should be %v", c.path, c.isDir, c.expected)
+    }
+  }
+}
+
+func TestRemove(t *testing.T) {
+  rules := exampleRules()
+  if !rules.Ignored("src/generated.go", false) {
+    t.Fatalf("src/generated.go should be ignored")
+  }
+  rules.Remove("src")
+  if rules.Ignored("src/generated.go", false) {
+    t.Fatalf("src/generated.go should no longer be ignored")
+  }
+}
@@ -10,9 +10,11 @@ import (
   "log"
   "io"
   "net"
+  "os"
+  "strings"
+  "sync"
   "time"
   "github.com/golang/protobuf/proto"
-  conf "github.com/tillberg/goconfig"
   "../blob"
   "../serializer"
   "../sharedpb"
@@ -20,7 +22,41 @@ import (
   "../types"
 )
 
-var apikey = ""
+// A Network connects one node to its peers.  Several can run in the same
+// process, each with its own port, hub and storage.
+type Network struct {
+  apikey     string
+  hub        *types.Hub
+  storage    storage.Storage
+  serializer serializer.Serializer
+  mutex      sync.Mutex
+  // The branches every peer is asked to keep us up to date on, starting
+  // with the remote branch of each share we serve
+  wanted     []types.BranchSubscription
+  // The names of the shares we serve; branches of any other are ignored
+  shares     map[string]bool
+  listener   *net.TCPListener
+  // Open connections, by where to send them messages
+  conns      map[*net.TCPConn]chan *sharedpb.Message
+  stopped    bool
+}
+
+func New(apikey string, hub *types.Hub, store storage.Storage, serializer serializer.Serializer,
+         shares []*blob.Share) *Network {
+  network := &Network{
+    apikey: apikey,
+    hub: hub,
+    storage: store,
+    serializer: serializer,
+    conns: map[*net.TCPConn]chan *sharedpb.Message{},
+    shares: map[string]bool{},
+  }
+  for _, share := range shares {
+    network.shares[share.Name] = true
+    network.wanted = append(network.wanted, types.BranchSubscription{Share: share.Name, Name: share.RemoteBranch})
+  }
+  return network
+}
 
 func GetShortHexString(bytes []byte) string {
   return GetHexString(bytes[:4])
@@ -38,7 +74,7 @@ func WriteUvarint(writer *bufio.Writer, number uint64) {
 
 // This is not a public-key cryptographic signature.  We should switch over
 // to a proper signature when we start to deal with multi-user schemes.
-func GenerateSignature(bytes []byte) []byte  {
+func GenerateSignature(apikey string, bytes []byte) []byte  {
   h := sha256.New()
   h.Write([]byte(apikey))
   h.Write(bytes)
@@ -46,16 +82,35 @@ func GenerateSignature(bytes []byte) []byte  {
   return h.Sum([]byte{})
 }
 
-func SendObject(hash types.Hash, dest chan *sharedpb.Message) {
-  blob := blob.GetBlob(hash)
-  data, err := serializer.Configured().Marshal(blob)
-  if err != nil { log.Fatal(err) }
-  compressed := storage.Configured().Deflate(data)
+// Only objects already in our cache are sent.  Asking our own peers on
+// someone else's behalf could bounce the request around the mesh forever.
+// Nothing is sent once closed is closed.
+func (network *Network) SendObject(hash types.Hash, dest chan *sharedpb.Message, closed <-chan struct{}) {
+  send := func(message *sharedpb.Message) {
+    select {
+      case dest <- message:
+      case <-closed:
+      case <-network.hub.Done:
+    }
+  }
+  blob, err := network.storage.Get(hash)
+  var data []byte
+  if err == nil {
+    data, err = network.serializer.Marshal(blob)
+  }
+  if err != nil {
+    if !os.IsNotExist(err) {
+      log.Printf("Error reading %s: %s", GetShortHexString(hash), err)
+    }
+    send(&sharedpb.Message{HashMissing: hash})
+    return
+  }
+  compressed := network.storage.Deflate(data)
   // log.Printf("bytes: %d", len(bytes))
-  dest <- &sharedpb.Message{Object: &sharedpb.Object{Hash: hash, Object: compressed}}
+  send(&sharedpb.Message{Object: &sharedpb.Object{Hash: hash, Object: compressed}})
 }
 
-func SendSignedMessage(message *sharedpb.Message, writer *bufio.Writer) error {
+func SendSignedMessage(message *sharedpb.Message, writer *bufio.Writer, apikey string) error {
   now := uint64(time.Now().Unix())
   message.Timestamp = &now
   // log.Printf("Going to send %s", message.MessageString())
@@ -63,7 +118,7 @@ func SendSignedMessage(message *sharedpb.Message, writer *bufio.Writer) error {
   if err != nil { return err }
   numMessageBytes := uint64(len(messageBytes))
   preamble := &sharedpb.Preamble{Length: &numMessageBytes}
-  preamble.Signature = GenerateSignature(messageBytes)
+  preamble.Signature = GenerateSignature(apikey, messageBytes)
   preambleBytes, err := proto.Marshal(preamble)
   if err != nil { return err }
   WriteUvarint(writer, uint64(len(preambleBytes)))
@@ -75,7 +130,7 @@ func SendSignedMessage(message *sharedpb.Message, writer *bufio.Writer) error {
   return nil
 }
 
-func SendSingleMessage(message *sharedpb.Message, address string) {
+func SendSingleMessage(message *sharedpb.Message, address string, apikey string) {
   start := time.Now()
   for {
     remoteAddr, err := net.ResolveTCPAddr("tcp", address)
@@ -89,7 +144,7 @@ func SendSingleMessage(message *sharedpb.Message, address string) {
       continue
     }
     writer := bufio.NewWriter(conn)
-    err = SendSignedMessage(message, writer)
+    err = SendSignedMessage(message, writer, apikey)
     if err != nil {
       log.Printf("Error sending single message: %s", err)
     }
@@ -97,7 +152,7 @@ func SendSingleMessage(message *sharedpb.Message, address string) {
   }
 }
 
-func ReceiveMessage(reader *bufio.Reader) (*sharedpb.Message, bool) {
+func ReceiveMessage(reader *bufio.Reader, apikey string) (*sharedpb.Message, bool) {
   preambleSize, err := binary.ReadUvarint(reader)
   if err != nil { log.Println(err); return nil, false }
   bufPreamble := make([]byte, preambleSize)
@@ -114,131 +169,368 @@ func ReceiveMessage(reader *bufio.Reader) (*sharedpb.Message, bool) {
   err = proto.Unmarshal(bufMessage, message)
   if err != nil { log.Println(err); return nil, false }
 
-  if preamble.Signature != nil {
-    correct := GenerateSignature(bufMessage)
-    if !bytes.Equal(preamble.Signature, correct) {
-      log.Println("Invalid message received")
-      return nil, false
-    }
+  correct := GenerateSignature(apikey, bufMessage)
+  if !bytes.Equal(preamble.Signature, correct) {
+    log.Println("Invalid message received")
+    return nil, false
   }
 
   return message, true
 }
 
-func SubscribeToBranch(name string, outbox chan *sharedpb.Message) {
+// Branch names from peers end up as paths in the cache, so anything that
+// could climb out of refs/heads is refused.
+func validBranchName(name string) bool {
+  if name == "" || strings.HasPrefix(name, "/") { return false }
+  for _, part := range strings.Split(name, "/") {
+    if part == "" || part == "." || part == ".." { return false }
+  }
+  return true
+}
+
+func subscriptionMessage(subscription types.BranchSubscription) *sharedpb.BranchSubscription {
+  return &sharedpb.BranchSubscription{
+    Share: &subscription.Share,
+    Name: &subscription.Name,
+    Prefix: &subscription.Prefix,
+  }
+}
+
+// Sends a message to every connected peer
+func (network *Network) broadcast(message *sharedpb.Message) {
+  network.mutex.Lock()
+  defer network.mutex.Unlock()
+  for _, outbox := range network.conns {
+    select {
+      case outbox <- message:
+      default:
+        log.Printf("Dropping message for a peer that isn't keeping up")
+    }
+  }
+}
+
+// Subscribe asks every peer, now and whenever one connects, for updates to
+// a branch, or with prefix set, every branch whose name begins with name.
+// Updates arrive as origin/<name>.
+func (network *Network) Subscribe(share string, name string, prefix bool) {
+  subscription := types.BranchSubscription{Share: share, Name: name, Prefix: prefix}
+  network.mutex.Lock()
+  for _, wanted := range network.wanted {
+    if wanted == subscription {
+      network.mutex.Unlock()
+      return
+    }
+  }
+  network.wanted = append(network.wanted, subscription)
+  network.mutex.Unlock()
+  network.broadcast(&sharedpb.Message{SubscribeBranch: subscriptionMessage(subscription)})
+}
+
+// Unsubscribe cancels a subscription made with Subscribe.
+func (network *Network) Unsubscribe(share string, name string, prefix bool) {
+  subscription := types.BranchSubscription{Share: share, Name: name, Prefix: prefix}
+  network.mutex.Lock()
+  remaining := []types.BranchSubscription{}
+  for _, wanted := range network.wanted {
+    if wanted != subscription {
+      remaining = append(remaining, wanted)
+    }
+  }
+  network.wanted = remaining
+  network.mutex.Unlock()
+  network.broadcast(&sharedpb.Message{UnsubscribeBranch: subscriptionMessage(subscription)})
+}
+
+// Forwards updates to the local branches a peer subscribed to until stop or
+// closed is closed, and then takes the subscription back out of the
+// arbiter.
+func (network *Network) forwardBranch(subscription types.BranchSubscription, outbox chan *sharedpb.Message,
+                                     stop <-chan struct{}, closed <-chan struct{}) {
   updateChannel := make(chan types.BranchStatus, 10)
-  types.BranchSubscribeChannel <- types.BranchSubscription{Name:name, ResponseChannel: updateChannel}
-  for {
+  subscription.ResponseChannel = updateChannel
+  select {
+    case network.hub.BranchSubscribeChannel <- subscription:
+    case <-network.hub.Done:
+      return
+  }
+  for forwarding := true; forwarding; {
     select {
       case update := <-updateChannel:
-        outbox <- &sharedpb.Message{Branch: &sharedpb.Branch{Name: &name, Hash: update.Hash}}
+        if strings.HasPrefix(update.Name, "origin/") {
+          // Only our own branches are passed on.  What we hear from other
+          // peers reaches the mesh by being merged into them.
+          continue
+        }
+        message := &sharedpb.Message{Branch: &sharedpb.Branch{Share: &update.Share, Name: &update.Name, Hash: update.Hash}}
+        select {
+          case outbox <- message:
+          case <-closed:
+            forwarding = false
+        }
+      case <-stop:
+        forwarding = false
+      case <-closed:
+        forwarding = false
+      case <-network.hub.Done:
+        return
+    }
+  }
+  // Keep draining updates until the arbiter has heard, so that it never
+  // blocks on us
+  for {
+    select {
+      case network.hub.BranchUnsubscribeChannel <- subscription:
+        return
+      case <-updateChannel:
+      case <-network.hub.Done:
+        return
     }
   }
 }
 
-func connOutgoing(conn *net.TCPConn, outbox chan *sharedpb.Message) {
-  s := "master"
-  outbox<-&sharedpb.Message{SubscribeBranch: &s}
-  types.BlobServicerChannel <- outbox
+func (network *Network) connOutgoing(conn *net.TCPConn, outbox chan *sharedpb.Message, closed chan struct{}) {
+  network.mutex.Lock()
+  wanted := append([]types.BranchSubscription{}, network.wanted...)
+  network.mutex.Unlock()
   writer := bufio.NewWriter(conn)
+  // Written straight out, since there may be more than the outbox holds
+  for _, subscription := range wanted {
+    err := SendSignedMessage(&sharedpb.Message{SubscribeBranch: subscriptionMessage(subscription)}, writer, network.apikey)
+    if err != nil {
+      log.Printf("Error sending message: %s", err)
+      conn.Close()
+      return
+    }
+  }
   for {
-    message := <- outbox
-    err := SendSignedMessage(message, writer)
+    var message *sharedpb.Message
+    select {
+      case message = <-outbox:
+      case <-closed:
+        return
+      case <-network.hub.Done:
+        return
+    }
+    err := SendSignedMessage(message, writer, network.apikey)
     if err != nil {
       log.Printf("Error sending message: %s", err)
-      break
+      // Hang up, so that the reading side notices too
+      conn.Close()
+      return
     }
     // log.Printf("Sent %s", message.MessageString())
   }
 }
 
-func connIncoming(conn *net.TCPConn, outbox chan *sharedpb.Message) {
+func (network *Network) connIncoming(conn *net.TCPConn, outbox chan *sharedpb.Message, closed chan struct{}) {
+  // The peer's subscriptions, by share, name and prefix, each closed to
+  // stop forwarding
+  served := map[types.BranchSubscription]chan struct{}{}
+  subscriptionOf := func(message *sharedpb.BranchSubscription) types.BranchSubscription {
+    return types.BranchSubscription{Share: message.GetShare(), Name: message.GetName(), Prefix: message.GetPrefix()}
+  }
   reader := bufio.NewReader(conn)
   for {
-    message, valid := ReceiveMessage(reader)
+    message, valid := ReceiveMessage(reader, network.apikey)
     if !valid { return }
     // log.Printf("Received %s", message.MessageString())
     if message.HashRequest != nil {
-      go SendObject(message.HashRequest, outbox)
+      hash := message.HashRequest
+      network.hub.Go(func() { network.SendObject(hash, outbox, closed) })
+    } else if message.HashMissing != nil {
+      select {
+        case network.hub.BlobDeclineChannel <- types.BlobDecline{Hash: message.HashMissing, Servicer: outbox}:
+        case <-network.hub.Done:
+          return
+      }
     } else if message.Object != nil {
-      data, err := storage.Configured().Inflate(message.Object.Object)
-      if err != nil { log.Fatal(err) }
-      blob, err := serializer.Configured().Unmarshal(data)
-      if err != nil { log.Fatal(err) }
-      types.BlobReceiveChannel <- blob
+      data, err := network.storage.Inflate(message.Object.Object)
+      if err != nil {
+        log.Printf("Dropping an object that won't inflate: %s", err)
+        continue
+      }
+      blob, err := network.serializer.Unmarshal(data)
+      if err != nil {
+        log.Printf("Dropping an object that won't unmarshal: %s", err)
+        continue
+      }
+      select {
+        case network.hub.BlobReceiveChannel <- blob:
+        case <-network.hub.Done:
+          return
+      }
     } else if message.Branch != nil {
+      share, name := message.Branch.GetShare(), message.Branch.GetName()
+      if !network.shares[share] || !validBranchName(name) {
+        log.Printf("Ignoring an update to %s/%s, which is malformed or not shared here", share, name)
+        continue
+      }
       branchUpdate := types.BranchStatus{
-        Name: fmt.Sprintf("origin/%s", *message.Branch.Name),
+        Share: share,
+        Name: fmt.Sprintf("origin/%s", name),
         Hash: message.Branch.Hash,
       }
-      types.BranchUpdateChannel <- branchUpdate
+      select {
+        case network.hub.BranchUpdateChannel <- branchUpdate:
+        case <-network.hub.Done:
+          return
+      }
     } else if message.SubscribeBranch != nil {
-      go SubscribeToBranch(*message.SubscribeBranch, outbox)
+      subscription := subscriptionOf(message.SubscribeBranch)
+      if served[subscription] == nil {
+        served[subscription] = make(chan struct{})
+        stop := served[subscription]
+        network.hub.Go(func() { network.forwardBranch(subscription, outbox, stop, closed) })
+      }
+    } else if message.UnsubscribeBranch != nil {
+      subscription := subscriptionOf(message.UnsubscribeBranch)
+      if served[subscription] != nil {
+        close(served[subscription])
+        delete(served, subscription)
+      }
     } else if message.AddRemote != nil {
       for _, address := range message.AddRemote {
-        go makeConnection(address)
+        address := address
+        network.hub.Go(func() { network.Connect(address) })
       }
     } else {
-      log.Fatal("Unknown incoming message", message.MessageString())
+      // Perhaps from a newer peer
+      log.Printf("Ignoring unknown message: %s", message.MessageString())
     }
   }
 }
 
-func startConnections(conn *net.TCPConn) {
+// Keeps track of open connections so that Stop can close them.  Returns
+// false once the network has been stopped.
+func (network *Network) track(conn *net.TCPConn, outbox chan *sharedpb.Message) bool {
+  network.mutex.Lock()
+  defer network.mutex.Unlock()
+  if network.stopped {
+    conn.Close()
+    return false
+  }
+  network.conns[conn] = outbox
+  return true
+}
+
+func (network *Network) startConnections(conn *net.TCPConn) {
   outbox := make(chan *sharedpb.Message, 10)
-  go connOutgoing(conn, outbox)
-  connIncoming(conn, outbox)
+  if !network.track(conn, outbox) { return }
+  // Closed once the connection is gone, which ends everything serving it
+  closed := make(chan struct{})
+  defer func() {
+    network.mutex.Lock()
+    delete(network.conns, conn)
+    network.mutex.Unlock()
+    close(closed)
+    conn.Close()
+    // Keep draining requests until the arbiter has heard, so that it never
+    // blocks on us
+    for {
+      select {
+        case network.hub.BlobServicerGoneChannel <- outbox:
+          return
+        case <-outbox:
+        case <-network.hub.Done:
+          return
+      }
+    }
+  }()
+  select {
+    case network.hub.BlobServicerChannel <- outbox:
+    case <-network.hub.Done:
+      return
+  }
+  network.hub.Go(func() { network.connOutgoing(conn, outbox, closed) })
+  network.connIncoming(conn, outbox, closed)
 }
 
-func makeConnection(address string) {
+// Connect dials a peer, retrying for a second before giving up, and
+// reconnects whenever the connection drops until the network is stopped.
+// Retries back off from 10ms, doubling each time, and each connection
+// that's made starts the second over.
+func (network *Network) Connect(address string) {
   start := time.Now()
+  delay := 10 * time.Millisecond
   for {
     remoteAddr, err := net.ResolveTCPAddr("tcp", address)
-    if err != nil { log.Fatal(err) }
+    if err != nil {
+      log.Printf("Unable to resolve %s: %s", address, err)
+      return
+    }
     conn, err := net.DialTCP("tcp", nil, remoteAddr)
     if err != nil {
       if time.Since(start) > time.Second {
-        log.Fatal(err)
+        log.Printf("Unable to connect to %s: %s", address, err)
+        return
       }
-      time.Sleep(10 * time.Millisecond)
+      select {
+        case <-time.After(delay):
+        case <-network.hub.Done:
+          return
+      }
+      delay *= 2
       continue
     }
     log.Printf("Connected to %s.", address)
-    startConnections(conn)
+    network.startConnections(conn)
+    start, delay = time.Now(), 10 * time.Millisecond
+    select {
+      case <-network.hub.Done:
+        return
+      default:
+    }
   }
 }
 
-func handleConnection(conn *net.TCPConn) {
+func (network *Network) handleConnection(conn *net.TCPConn) {
   log.Printf("Connection received from %s", conn.RemoteAddr().String())
-  startConnections(conn)
+  network.startConnections(conn)
 }
 
-func ListenForConnections(ln *net.TCPListener) {
+func (network *Network) listenForConnections(ln *net.TCPListener) {
   for {
     conn, err := ln.AcceptTCP()
     if err != nil {
+      select {
+        case <-network.hub.Done:
+          return
+        default:
+      }
       log.Print(err)
       continue
     }
-    go handleConnection(conn)
+    network.hub.Go(func() { network.handleConnection(conn) })
   }
 }
 
-func Start(listenPort int) {
-  listen_addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%d", listenPort))
-  if err != nil { log.Fatal(err) }
-  ln, err := net.ListenTCP("tcp", listen_addr)
-  if err != nil { log.Fatal(err) }
-  defer ln.Close()
+// Start listens for peers on listenPort, accepting connections in the
+// background.
+func (network *Network) Start(listenPort int) error {
+  listenAddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%d", listenPort))
+  if err != nil { return err }
+  ln, err := net.ListenTCP("tcp", listenAddr)
+  if err != nil { return err }
+  network.mutex.Lock()
+  network.listener = ln
+  network.mutex.Unlock()
   log.Printf("Listening on port %d.", listenPort)
   // XXX omg kludge.  Need to figure out how to properly negotiate
   // unique full-duplex P2P connections.
-  ListenForConnections(ln)
+  network.hub.Go(func() { network.listenForConnections(ln) })
+  return nil
 }
 
-func init() {
-  config, err := conf.ReadConfigFile("shared.ini")
-  if err != nil { log.Fatal(err) }
-  apikey, err = config.GetString("main", "apikey")
-  if err != nil { log.Fatal(err) }
+// Stop closes the listener and every open connection.  The hub's Done
+// channel should be closed first, so that nothing tries to reconnect.
+func (network *Network) Stop() {
+  network.mutex.Lock()
+  defer network.mutex.Unlock()
+  network.stopped = true
+  if network.listener != nil {
+    network.listener.Close()
+  }
+  for conn := range network.conns {
+    conn.Close()
+  }
 }
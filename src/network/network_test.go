@@ -0,0 +1,18 @@
+package network
+
+import (
+  "testing"
+)
+
+func TestValidBranchName(t *testing.T) {
+  for _, name := range []string{"master", "laptop/master", "origin/a.b"} {
+    if !validBranchName(name) {
+      t.Errorf("Expected %s to be accepted", name)
+    }
+  }
+  for _, name := range []string{"", "/etc/passwd", "../../objects/ab", "a/../../b", "a//b", "a/", "."} {
+    if validBranchName(name) {
+      t.Errorf("Expected %s to be refused", name)
+    }
+  }
+}
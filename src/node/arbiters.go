@@ -0,0 +1,233 @@
+package node
+
+import (
+  "bytes"
+  "context"
+  "log"
+  "sort"
+  "strings"
+  "../blob"
+  "../sharedpb"
+  "../types"
+)
+
+// An object being fetched, who is waiting for it, and which peers have yet
+// to answer
+type pendingBlobRequest struct {
+  hash        types.Hash
+  subscribers []chan types.BlobResponse
+  asked       map[chan *sharedpb.Message]bool
+}
+
+func (node *Node) arbitBlobRequests() {
+  servicers := []chan *sharedpb.Message{}
+  // Servicers that went away, possibly before we heard they'd arrived
+  gone := map[chan *sharedpb.Message]bool{}
+  pending := map[string]*pendingBlobRequest{}
+  respond := func(hash types.Hash, found bool) {
+    hashString := blob.GetHexString(hash)
+    if pending[hashString] == nil { return }
+    // Each subscriber has room for its one response
+    for _, subscriber := range pending[hashString].subscribers {
+      subscriber <- types.BlobResponse{Hash: hash, Found: found}
+    }
+    delete(pending, hashString)
+  }
+  for {
+    select {
+      case servicer := <-node.hub.BlobServicerChannel:
+        if gone[servicer] {
+          delete(gone, servicer)
+          continue
+        }
+        servicers = append(servicers, servicer)
+      case servicer := <-node.hub.BlobServicerGoneChannel:
+        remaining := []chan *sharedpb.Message{}
+        for _, other := range servicers {
+          if other != servicer {
+            remaining = append(remaining, other)
+          }
+        }
+        if len(remaining) == len(servicers) {
+          gone[servicer] = true
+        }
+        servicers = remaining
+        // Nobody is left to answer for it
+        for _, request := range pending {
+          if request.asked[servicer] {
+            delete(request.asked, servicer)
+            if len(request.asked) == 0 {
+              respond(request.hash, false)
+            }
+          }
+        }
+      case request := <-node.hub.BlobRequestChannel:
+        hashString := blob.GetHexString(request.Hash)
+        // log.Printf("Waiting for %s", blob.GetShortHexString(request.Hash))
+        if pending[hashString] == nil {
+          pending[hashString] = &pendingBlobRequest{hash: request.Hash, asked: map[chan *sharedpb.Message]bool{}}
+        }
+        pending[hashString].subscribers = append(pending[hashString].subscribers, request.ResponseChannel)
+        _, err := node.storage.Get(request.Hash)
+        if err == nil {
+          // Arrived between the requester looking for it and asking
+          respond(request.Hash, true)
+          continue
+        }
+        for _, servicer := range servicers {
+          pending[hashString].asked[servicer] = true
+          select {
+            case servicer <- &sharedpb.Message{HashRequest: request.Hash}:
+            case <-node.hub.Done:
+              return
+          }
+        }
+        if len(pending[hashString].asked) == 0 {
+          respond(request.Hash, false)
+        }
+      case decline := <-node.hub.BlobDeclineChannel:
+        request := pending[blob.GetHexString(decline.Hash)]
+        if request == nil { continue }
+        delete(request.asked, decline.Servicer)
+        if len(request.asked) == 0 {
+          respond(decline.Hash, false)
+        }
+      case receivedBlob := <-node.hub.BlobReceiveChannel:
+        hash, err := node.storage.Put(receivedBlob)
+        if err != nil {
+          // Whoever is waiting will time out and ask again
+          log.Printf("Error storing received object: %s", err)
+          continue
+        }
+        // log.Printf("Forwarding %s", blob.GetShortHexString(hash))
+        respond(hash, true)
+      case <-node.hub.Done:
+        return
+    }
+  }
+}
+
+// Branch tips, remote-tracking branches included, are kept as refs named by
+// blob.RefName, so that a restart picks up where the last run left off.
+// Refs of shares no longer served are left alone.
+func (node *Node) loadBranchStatuses() map[string]*types.BranchStatus {
+  statuses := map[string]*types.BranchStatus{}
+  refs, err := node.storage.ListRefs()
+  if err != nil {
+    log.Printf("Error reading refs: %s", err)
+    return statuses
+  }
+  served := map[string]bool{}
+  for _, share := range node.shares {
+    served[share.Name] = true
+  }
+  for ref, hash := range refs {
+    if len(hash) == 0 { continue }
+    share, name := blob.DefaultShareName, ref
+    slash := strings.Index(ref, "/")
+    if slash >= 0 && served[ref[:slash]] && ref[:slash] != blob.DefaultShareName {
+      share, name = ref[:slash], ref[slash + 1:]
+    }
+    if !served[share] { continue }
+    statuses[share + "/" + name] = &types.BranchStatus{Share: share, Name: name, Hash: hash}
+  }
+  return statuses
+}
+
+func (node *Node) arbitBranchStatus() {
+  subscribers := []types.BranchSubscription{}
+  statuses := node.loadBranchStatuses()
+  for {
+    select {
+      case subscription := <-node.hub.BranchSubscribeChannel:
+        subscribers = append(subscribers, subscription)
+        // Catch the subscriber up on every branch it matches, in order
+        names := []string{}
+        for branch, status := range statuses {
+          if subscription.Matches(*status) {
+            names = append(names, branch)
+          }
+        }
+        sort.Strings(names)
+        for _, branch := range names {
+          select {
+            case subscription.ResponseChannel <- *statuses[branch]:
+            case <-node.hub.Done:
+              return
+          }
+        }
+      case unsubscription := <-node.hub.BranchUnsubscribeChannel:
+        remaining := []types.BranchSubscription{}
+        for _, subscriber := range subscribers {
+          if subscriber != unsubscription {
+            remaining = append(remaining, subscriber)
+          }
+        }
+        subscribers = remaining
+      case branchStatus := <-node.hub.BranchUpdateChannel:
+        branch := branchStatus.Share + "/" + branchStatus.Name
+        current := statuses[branch]
+        if current != nil && bytes.Equal(branchStatus.Hash, current.Hash) {
+          continue
+        }
+        // Local branches only move when their share commits, so they're
+        // taken as they come.  Remote-tracking branches hear from every peer,
+        // so an update already contained in what we have is dropped, and one
+        // that diverged from it is passed along to be merged, after which
+        // the merge goes back out to the whole mesh.
+        if current != nil && strings.HasPrefix(branchStatus.Name, "origin/") &&
+           !node.env.DoesADescendFromB(branchStatus.Hash, current.Hash) {
+          if node.env.DoesADescendFromB(current.Hash, branchStatus.Hash) {
+            log.Printf("Ignoring %s -> %s", branch, blob.GetShortHexString(branchStatus.Hash))
+            continue
+          }
+          log.Printf("%s has diverged: %s and %s", branch, blob.GetShortHexString(current.Hash),
+                     blob.GetShortHexString(branchStatus.Hash))
+        }
+        log.Printf("Updating %s -> %s", branch, blob.GetShortHexString(branchStatus.Hash))
+        statuses[branch] = &branchStatus
+        err := node.storage.PutRef(blob.RefName(branchStatus.Share, branchStatus.Name), branchStatus.Hash)
+        if err != nil {
+          log.Printf("Error saving %s: %s", branch, err)
+        }
+        for _, subscriber := range subscribers {
+          if subscriber.Matches(branchStatus) {
+            select {
+              case subscriber.ResponseChannel <- branchStatus:
+              case <-node.hub.Done:
+                return
+            }
+          }
+        }
+      case <-node.hub.Done:
+        return
+    }
+  }
+}
+
+func (node *Node) arbitCommitHierarchy() {
+  graph := node.env.LoadCommitGraph()
+  for {
+    select {
+      case query := <- node.hub.DoesADescendFromBChannel:
+        descends, err := graph.Descends(context.Background(), query.CommitA, query.CommitB)
+        if err != nil {
+          // Without the history, assume the worst: that it doesn't
+          log.Printf("Could not tell whether %s descends from %s: %s", blob.GetShortHexString(query.CommitA),
+                     blob.GetShortHexString(query.CommitB), err)
+        }
+        query.ResponseChannel <- descends
+      case query := <-node.hub.MergeBaseChannel:
+        base, err := graph.MergeBase(context.Background(), query.CommitA, query.CommitB)
+        query.ResponseChannel <- types.MergeBaseResponse{Base: base, Err: err}
+      case query := <-node.hub.AheadBehindChannel:
+        ahead, behind, err := graph.AheadBehind(context.Background(), query.Local, query.Remote)
+        query.ResponseChannel <- types.AheadBehindResponse{Ahead: ahead, Behind: behind, Err: err}
+      case query := <-node.hub.CommitsBetweenChannel:
+        commits, err := graph.CommitsBetween(context.Background(), query.CommitA, query.CommitB)
+        query.ResponseChannel <- types.CommitsBetweenResponse{Commits: commits, Err: err}
+      case <-node.hub.Done:
+        return
+    }
+  }
+}
@@ -0,0 +1,206 @@
+package node
+
+import (
+  "bytes"
+  "io/ioutil"
+  "os"
+  "testing"
+  "time"
+  "../blob"
+  "../serializer"
+  "../sharedpb"
+  "../storage"
+  "../types"
+)
+
+// A node with just enough to run its arbiters, caching in a temporary
+// directory that cleanup removes
+func newTestNode(t *testing.T, shares []*blob.Share) (node *Node, cleanup func()) {
+  root, err := ioutil.TempDir("", "shared-node")
+  if err != nil { t.Fatal(err) }
+  gutSerializer, err := serializer.New("gut")
+  if err != nil { t.Fatal(err) }
+  store, err := storage.New("gut", root, gutSerializer)
+  if err != nil { t.Fatal(err) }
+  node = &Node{hub: types.NewHub(), storage: store, shares: shares}
+  node.env = blob.NewEnv(node.hub, store, root, nil)
+  return node, func() { os.RemoveAll(root) }
+}
+
+// A hash of full length, for anything that logs it
+func fullHash(first byte) types.Hash {
+  hash := make(types.Hash, 20)
+  hash[0] = first
+  return hash
+}
+
+func TestLoadBranchStatuses(t *testing.T) {
+  refs := map[string]types.Hash{
+    "master": types.Hash{1},
+    "origin/master": types.Hash{2},
+    "docs/laptop": types.Hash{3},
+    "docs/origin/laptop": types.Hash{4},
+  }
+  defaultShare := &blob.Share{Name: blob.DefaultShareName}
+  docsShare := &blob.Share{Name: "docs"}
+  cases := []struct {
+    shares   []*blob.Share
+    expected map[string]types.Hash
+  }{
+    {[]*blob.Share{defaultShare, docsShare}, map[string]types.Hash{
+      "default/master": types.Hash{1},
+      "default/origin/master": types.Hash{2},
+      "docs/laptop": types.Hash{3},
+      "docs/origin/laptop": types.Hash{4},
+    }},
+    // Refs of shares no longer served are left out
+    {[]*blob.Share{docsShare}, map[string]types.Hash{
+      "docs/laptop": types.Hash{3},
+      "docs/origin/laptop": types.Hash{4},
+    }},
+  }
+  for _, c := range cases {
+    node, cleanup := newTestNode(t, c.shares)
+    defer cleanup()
+    for name, hash := range refs {
+      err := node.storage.PutRef(name, hash)
+      if err != nil { t.Fatal(err) }
+    }
+    statuses := node.loadBranchStatuses()
+    if len(statuses) != len(c.expected) {
+      t.Errorf("Expected %d branches, got %d", len(c.expected), len(statuses))
+    }
+    for branch, hash := range c.expected {
+      status := statuses[branch]
+      if status == nil || !bytes.Equal(status.Hash, hash) || status.Share + "/" + status.Name != branch {
+        t.Errorf("Expected %s at %x, got %v", branch, hash, status)
+      }
+    }
+  }
+}
+
+func TestArbitBlobRequests(t *testing.T) {
+  node, cleanup := newTestNode(t, nil)
+  defer cleanup()
+  defer close(node.hub.Done)
+  go node.arbitBlobRequests()
+  // Once a buffered channel has been drained, a send on the unbuffered
+  // gone channel only goes through after whatever was taken is handled
+  settle := func(pending func() int) {
+    for pending() > 0 {
+      time.Sleep(time.Millisecond)
+    }
+    node.hub.BlobServicerGoneChannel <- make(chan *sharedpb.Message)
+  }
+  servicers := []chan *sharedpb.Message{}
+  for i := 0; i < 2; i++ {
+    servicer := make(chan *sharedpb.Message, 10)
+    servicers = append(servicers, servicer)
+    node.hub.BlobServicerChannel <- servicer
+  }
+  settle(func() int { return len(node.hub.BlobServicerChannel) })
+  request := func(hash types.Hash) chan types.BlobResponse {
+    responseChannel := make(chan types.BlobResponse, 1)
+    node.hub.BlobRequestChannel <- types.BlobRequest{Hash: hash, ResponseChannel: responseChannel}
+    settle(func() int { return len(node.hub.BlobRequestChannel) })
+    return responseChannel
+  }
+  asked := func(servicer chan *sharedpb.Message, hash types.Hash) bool {
+    select {
+      case message := <-servicer:
+        return bytes.Equal(message.HashRequest, hash)
+      default:
+        return false
+    }
+  }
+  hash := make(types.Hash, 20)
+  responseChannel := request(hash)
+  for i, servicer := range servicers {
+    if !asked(servicer, hash) {
+      t.Errorf("Expected servicer %d to be asked for the object", i)
+    }
+  }
+  node.hub.BlobDeclineChannel <- types.BlobDecline{Hash: hash, Servicer: servicers[0]}
+  settle(func() int { return len(node.hub.BlobDeclineChannel) })
+  if len(responseChannel) != 0 {
+    t.Errorf("Expected no answer while a servicer has yet to decline")
+  }
+  // The last one left hangs up instead of answering
+  node.hub.BlobServicerGoneChannel <- servicers[1]
+  select {
+    case response := <-responseChannel:
+      if response.Found {
+        t.Errorf("Expected the object not to be found")
+      }
+    case <-time.After(time.Second):
+      t.Fatalf("No answer once every servicer had declined or gone")
+  }
+
+  // Heard of going before arriving, so never asked
+  late := make(chan *sharedpb.Message, 10)
+  node.hub.BlobServicerGoneChannel <- late
+  node.hub.BlobServicerChannel <- late
+  settle(func() int { return len(node.hub.BlobServicerChannel) })
+  hash = append(types.Hash{1}, hash[1:]...)
+  responseChannel = request(hash)
+  if !asked(servicers[0], hash) || asked(servicers[1], hash) || asked(late, hash) {
+    t.Errorf("Expected only the remaining servicer to be asked")
+  }
+  node.hub.BlobDeclineChannel <- types.BlobDecline{Hash: hash, Servicer: servicers[0]}
+  select {
+    case response := <-responseChannel:
+      if response.Found {
+        t.Errorf("Expected the object not to be found")
+      }
+    case <-time.After(time.Second):
+      t.Fatalf("No answer once every servicer had declined")
+  }
+}
+
+func TestArbitBranchStatus(t *testing.T) {
+  node, cleanup := newTestNode(t, []*blob.Share{{Name: "docs"}, {Name: "music"}})
+  defer cleanup()
+  defer close(node.hub.Done)
+  node.storage.PutRef("docs/origin/master", fullHash(1))
+  node.storage.PutRef("docs/laptop", fullHash(2))
+  node.storage.PutRef("music/origin/master", fullHash(3))
+  go node.arbitBranchStatus()
+  expect := func(subscription types.BranchSubscription, name string, hash types.Hash) {
+    select {
+      case status := <-subscription.ResponseChannel:
+        if status.Share != subscription.Share || status.Name != name || !bytes.Equal(status.Hash, hash) {
+          t.Errorf("Expected %s/%s at %x, got %v", subscription.Share, name, hash, status)
+        }
+      case <-time.After(time.Second):
+        t.Fatalf("Expected %s/%s to be sent", subscription.Share, name)
+    }
+  }
+  // Subscribers are caught up on what's already known, in order
+  remotes := types.BranchSubscription{Share: "docs", Name: "origin/", Prefix: true,
+                                      ResponseChannel: make(chan types.BranchStatus, 10)}
+  laptop := types.BranchSubscription{Share: "docs", Name: "laptop", ResponseChannel: make(chan types.BranchStatus, 10)}
+  node.hub.BranchSubscribeChannel <- remotes
+  node.hub.BranchSubscribeChannel <- laptop
+  expect(remotes, "origin/master", fullHash(1))
+  expect(laptop, "laptop", fullHash(2))
+  // New branches go to whoever matches them
+  node.hub.BranchUpdateChannel <- types.BranchStatus{Share: "docs", Name: "origin/laptop", Hash: fullHash(4)}
+  node.hub.BranchUpdateChannel <- types.BranchStatus{Share: "music", Name: "origin/laptop", Hash: fullHash(5)}
+  node.hub.BranchUpdateChannel <- types.BranchStatus{Share: "docs", Name: "laptop", Hash: fullHash(6)}
+  expect(remotes, "origin/laptop", fullHash(4))
+  expect(laptop, "laptop", fullHash(6))
+  node.hub.BranchUnsubscribeChannel <- laptop
+  for len(node.hub.BranchUnsubscribeChannel) > 0 || len(node.hub.BranchUpdateChannel) > 0 {
+    time.Sleep(time.Millisecond)
+  }
+  node.hub.BranchUpdateChannel <- types.BranchStatus{Share: "docs", Name: "laptop", Hash: fullHash(7)}
+  node.hub.BranchUpdateChannel <- types.BranchStatus{Share: "docs", Name: "origin/desktop", Hash: fullHash(8)}
+  expect(remotes, "origin/desktop", fullHash(8))
+  if len(remotes.ResponseChannel) != 0 || len(laptop.ResponseChannel) != 0 {
+    t.Errorf("Expected nothing more to be sent, and nothing at all once unsubscribed")
+  }
+  hash, err := node.storage.GetRef("docs/laptop")
+  if err != nil || !bytes.Equal(hash, fullHash(7)) {
+    t.Errorf("Expected the update to be saved, got %x (%v)", hash, err)
+  }
+}
@@ -0,0 +1,176 @@
+package node
+
+import (
+  "errors"
+  "log"
+  "sync"
+  "time"
+  conf "github.com/tillberg/goconfig"
+  "../blob"
+  "../network"
+  "../serializer"
+  "../storage"
+  "../types"
+)
+
+// Options for a Node.  Anything not set here comes from the config file.
+type Options struct {
+  // The config file, shared.ini by default
+  ConfigPath string
+  // Where objects, refs and per-share state are kept
+  CacheRoot  string
+  ListenPort int
+  // The directory to sync, if no shares are configured
+  WatchPath  string
+  // Overrides the shares configured in the config file
+  Shares     []*blob.Share
+  // Overrides `apikey` in the config file
+  APIKey     string
+}
+
+// A Node is one peer: its shares, the arbiters coordinating them and its
+// connections to other peers.  Nodes share nothing with one another, so a
+// process can run several.
+type Node struct {
+  options    Options
+  config     *conf.ConfigFile
+  hub        *types.Hub
+  storage    storage.Storage
+  serializer serializer.Serializer
+  env        *blob.Env
+  shares     []*blob.Share
+  network    *network.Network
+  stopOnce   sync.Once
+}
+
+// New reads the config and opens the cache, but starts nothing.
+func New(options Options) (*Node, error) {
+  if options.ConfigPath == "" {
+    options.ConfigPath = "shared.ini"
+  }
+  if options.CacheRoot == "" {
+    return nil, errors.New("no cache root given")
+  }
+  config, err := conf.ReadConfigFile(options.ConfigPath)
+  if err != nil { return nil, err }
+  serializerKind, err := config.GetString("main", "serializer")
+  if err != nil { return nil, err }
+  storageKind, err := config.GetString("main", "storage")
+  if err != nil { return nil, err }
+  if options.APIKey == "" {
+    options.APIKey, err = config.GetString("main", "apikey")
+    if err != nil { return nil, err }
+  }
+  node := &Node{options: options, config: config, hub: types.NewHub()}
+  node.serializer, err = serializer.New(serializerKind)
+  if err != nil { return nil, err }
+  node.storage, err = storage.New(storageKind, options.CacheRoot, node.serializer)
+  if err != nil { return nil, err }
+  node.env = blob.NewEnv(node.hub, node.storage, options.CacheRoot, config)
+  node.shares = options.Shares
+  if node.shares == nil {
+    node.shares, err = blob.ConfiguredShares(config, options.WatchPath)
+    if err != nil { return nil, err }
+  }
+  for _, share := range node.shares {
+    err = share.Validate()
+    if err != nil { return nil, err }
+  }
+  node.network = network.New(options.APIKey, node.hub, node.storage, node.serializer, node.shares)
+  return node, nil
+}
+
+// Start begins syncing every share and listening for peers.
+func (node *Node) Start() error {
+  node.hub.Go(node.arbitBranchStatus)
+  node.hub.Go(node.arbitBlobRequests)
+  node.hub.Go(node.arbitCommitHierarchy)
+  node.env.StartProcessors()
+  for _, share := range node.shares {
+    node.env.MakeBranch(share, nil, nil)
+  }
+  if node.env.RetentionConfigured() {
+    node.hub.Go(node.collectGarbage)
+  }
+  return node.network.Start(node.options.ListenPort)
+}
+
+// How often objects dropped from history by thinning are cleaned up
+const gcInterval = 6 * time.Hour
+
+func (node *Node) collectGarbage() {
+  ticker := time.NewTicker(gcInterval)
+  defer ticker.Stop()
+  for {
+    select {
+      case <-ticker.C:
+        _, err := node.env.CollectGarbage()
+        if err != nil {
+          log.Printf("Error collecting garbage: %s", err)
+        }
+      case <-node.hub.Done:
+        return
+    }
+  }
+}
+
+// Stop shuts down everything Start began, returning once it has all
+// finished.  Changes still settling are dropped, to be picked up from the
+// index on the next start.
+func (node *Node) Stop() {
+  node.stopOnce.Do(func() {
+    close(node.hub.Done)
+    node.network.Stop()
+  })
+  node.hub.Wait()
+}
+
+// Connect adds a peer, reconnecting to it whenever the connection drops.
+func (node *Node) Connect(address string) {
+  node.hub.Go(func() { node.network.Connect(address) })
+}
+
+func (node *Node) Shares() []*blob.Share {
+  return node.shares
+}
+
+// Subscribe sends the current state of every branch the subscription
+// matches to its ResponseChannel, and then every update to them, until
+// Unsubscribe.  The channel must be kept drained.
+func (node *Node) Subscribe(subscription types.BranchSubscription) {
+  select {
+    case node.hub.BranchSubscribeChannel <- subscription:
+    case <-node.hub.Done:
+  }
+}
+
+// Unsubscribe cancels a subscription, discarding any updates that arrive
+// for it in the meantime.
+func (node *Node) Unsubscribe(subscription types.BranchSubscription) {
+  for {
+    select {
+      case node.hub.BranchUnsubscribeChannel <- subscription:
+        return
+      case <-subscription.ResponseChannel:
+      case <-node.hub.Done:
+        return
+    }
+  }
+}
+
+// Conflicts delivers each conflict met while merging, once the merge has
+// been committed.  Conflicts that arrive while the channel is full are
+// dropped, so it should be kept drained.
+func (node *Node) Conflicts() <-chan types.Conflict {
+  return node.hub.ConflictChannel
+}
+
+// SubscribeRemote asks every peer for updates to a branch, or every branch
+// beginning with name if prefix is set.  They arrive as origin/<name>.
+func (node *Node) SubscribeRemote(share string, name string, prefix bool) {
+  node.network.Subscribe(share, name, prefix)
+}
+
+func (node *Node) UnsubscribeRemote(share string, name string, prefix bool) {
+  node.network.Unsubscribe(share, name, prefix)
+}
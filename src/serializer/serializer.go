@@ -2,8 +2,7 @@
 package serializer
 
 import (
-  "log"
-  conf "github.com/tillberg/goconfig"
+  "fmt"
   "../types"
   "./gut"
   "./proto"
@@ -14,17 +13,12 @@ type Serializer interface {
   Marshal(blob types.Blob) ([]byte, error)
 }
 
-func Configured() Serializer {
-  config, err := conf.ReadConfigFile("shared.ini")
-  types.Check(err)
-  serializer, err := config.GetString("main", "serializer")
-  types.Check(err)
-  if serializer == "gut" {
-    return Serializer(&gut.Serializer{})
-  } else if serializer == "proto" {
-    return Serializer(&proto.Serializer{})
-  } else {
-    log.Fatalf("Unrecognized serializer configured: %s", serializer)
+// New returns the serializer of the given kind: gut or proto.
+func New(kind string) (Serializer, error) {
+  if kind == "gut" {
+    return Serializer(&gut.Serializer{}), nil
+  } else if kind == "proto" {
+    return Serializer(&proto.Serializer{}), nil
   }
-  return nil
+  return nil, fmt.Errorf("Unrecognized serializer configured: %s", kind)
 }
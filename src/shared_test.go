@@ -4,6 +4,7 @@ package shared_test
 import (
   "os"
   "path"
+  "path/filepath"
   "testing"
   "time"
   "./test"
@@ -24,6 +25,48 @@ func AssertContents(t *testing.T, timeout time.Duration, path string, contents s
   }
 }
 
+func AssertMode(t *testing.T, timeout time.Duration, path string, mode os.FileMode) {
+  start := time.Now()
+  for {
+    statbuf, err := os.Lstat(path)
+    if err == nil && statbuf.Mode().Perm() == mode {
+      return
+    }
+    if (time.Since(start) > timeout) {
+      t.Fatalf("%s failed to have mode %o", path, mode)
+    }
+    time.Sleep(time.Millisecond)
+  }
+}
+
+func AssertSymlink(t *testing.T, timeout time.Duration, path string, target string) {
+  start := time.Now()
+  for {
+    linkTarget, err := os.Readlink(path)
+    if err == nil && linkTarget == target {
+      return
+    }
+    if (time.Since(start) > timeout) {
+      t.Fatalf("%s failed to link to `%s`", path, target)
+    }
+    time.Sleep(time.Millisecond)
+  }
+}
+
+func AssertMissing(t *testing.T, timeout time.Duration, path string) {
+  start := time.Now()
+  for {
+    _, err := os.Lstat(path)
+    if os.IsNotExist(err) {
+      return
+    }
+    if (time.Since(start) > timeout) {
+      t.Fatalf("%s failed to be removed", path)
+    }
+    time.Sleep(time.Millisecond)
+  }
+}
+
 var fastTimeout = 100 * time.Millisecond
 var timeout = 250 * time.Millisecond
 
@@ -98,6 +141,125 @@ func TestMultipleRevisionLateStartup(t* testing.T) {
   AssertContents(t, timeout, "/tmp/sync2/testfile", "hello")
 }
 
+func TestNestedDirectories(t* testing.T) {
+  setup := test.SetUp()
+  defer test.TearDown(setup)
+  WriteFile("/tmp/sync1/a/testfile", "hello")
+  WriteFile("/tmp/sync1/a/b/c/testfile", "hello to you")
+  AssertContents(t, timeout, "/tmp/sync2/a/testfile", "hello")
+  AssertContents(t, fastTimeout, "/tmp/sync2/a/b/c/testfile", "hello to you")
+}
+
+func TestNestedDirectoriesBefore(t* testing.T) {
+  test.Cleanup()
+  WriteFile("/tmp/sync1/testfile", "hello")
+  WriteFile("/tmp/sync1/a/testfile", "hello to you")
+  setup := test.Start()
+  defer test.TearDown(setup)
+  AssertContents(t, timeout, "/tmp/sync2/testfile", "hello")
+  AssertContents(t, fastTimeout, "/tmp/sync2/a/testfile", "hello to you")
+}
+
+func TestExecutable(t* testing.T) {
+  setup := test.SetUp()
+  defer test.TearDown(setup)
+  WriteFile("/tmp/sync1/script.sh", "#!/bin/sh\n")
+  os.Chmod("/tmp/sync1/script.sh", 0755)
+  AssertContents(t, timeout, "/tmp/sync2/script.sh", "#!/bin/sh\n")
+  AssertMode(t, timeout, "/tmp/sync2/script.sh", 0755)
+  os.Chmod("/tmp/sync1/script.sh", 0644)
+  AssertMode(t, timeout, "/tmp/sync2/script.sh", 0644)
+}
+
+func TestSymlink(t* testing.T) {
+  setup := test.SetUp()
+  defer test.TearDown(setup)
+  WriteFile("/tmp/sync1/testfile", "hello")
+  os.Symlink("testfile", "/tmp/sync1/link")
+  os.Symlink("/etc/passwd", "/tmp/sync1/badlink")
+  WriteFile("/tmp/sync1/testfile2", "hello to you")
+  AssertSymlink(t, timeout, "/tmp/sync2/link", "testfile")
+  AssertContents(t, fastTimeout, "/tmp/sync2/testfile2", "hello to you")
+  _, err := os.Lstat("/tmp/sync2/badlink")
+  if err == nil {
+    t.Fatalf("symlink pointing outside the share was synced")
+  }
+}
+
+func TestIgnore(t* testing.T) {
+  test.Cleanup()
+  WriteFile("/tmp/sync1/.sharedignore", "*.swp\nbuild/\n")
+  WriteFile("/tmp/sync1/build/output", "ignored")
+  setup := test.Start()
+  defer test.TearDown(setup)
+  WriteFile("/tmp/sync1/.testfile.swp", "ignored")
+  WriteFile("/tmp/sync1/testfile", "hello")
+  AssertContents(t, timeout, "/tmp/sync2/testfile", "hello")
+  AssertContents(t, fastTimeout, "/tmp/sync2/.sharedignore", "*.swp\nbuild/\n")
+  for _, path := range []string{"/tmp/sync2/.testfile.swp", "/tmp/sync2/build/output"} {
+    _, err := os.Lstat(path)
+    if err == nil {
+      t.Fatalf("%s should have been ignored", path)
+    }
+  }
+}
+
+func TestMergeOffline(t* testing.T) {
+  setup := test.SetUp()
+  WriteFile("/tmp/sync1/testfile", "hello")
+  AssertContents(t, timeout, "/tmp/sync2/testfile", "hello")
+  test.Stop(setup)
+  WriteFile("/tmp/sync1/testfile1", "from a")
+  WriteFile("/tmp/sync2/testfile2", "from b")
+  setup = test.Start()
+  defer test.TearDown(setup)
+  AssertContents(t, timeout, "/tmp/sync1/testfile2", "from b")
+  AssertContents(t, timeout, "/tmp/sync2/testfile1", "from a")
+  AssertContents(t, fastTimeout, "/tmp/sync1/testfile", "hello")
+  AssertContents(t, fastTimeout, "/tmp/sync2/testfile", "hello")
+}
+
+func TestConflictCopy(t* testing.T) {
+  setup := test.SetUp()
+  WriteFile("/tmp/sync1/testfile.txt", "hello")
+  AssertContents(t, timeout, "/tmp/sync2/testfile.txt", "hello")
+  test.Stop(setup)
+  WriteFile("/tmp/sync1/testfile.txt", "hello from a")
+  WriteFile("/tmp/sync2/testfile.txt", "hello from b")
+  setup = test.Start()
+  defer test.TearDown(setup)
+  start := time.Now()
+  for {
+    copies1, _ := filepath.Glob("/tmp/sync1/testfile (conflict from *).txt")
+    copies2, _ := filepath.Glob("/tmp/sync2/testfile (conflict from *).txt")
+    if len(copies1) == 1 && len(copies2) == 1 && path.Base(copies1[0]) == path.Base(copies2[0]) {
+      break
+    }
+    if (time.Since(start) > timeout) {
+      t.Fatalf("Expected a single matching conflict copy on each side, found %v and %v", copies1, copies2)
+    }
+    time.Sleep(time.Millisecond)
+  }
+  bytes1, _ := ioutil.ReadFile("/tmp/sync1/testfile.txt")
+  bytes2, _ := ioutil.ReadFile("/tmp/sync2/testfile.txt")
+  if string(bytes1) != string(bytes2) {
+    t.Fatalf("Peers kept different versions: `%s` and `%s`", bytes1, bytes2)
+  }
+}
+
+func TestDeletion(t* testing.T) {
+  setup := test.SetUp()
+  defer test.TearDown(setup)
+  WriteFile("/tmp/sync1/testfile", "hello")
+  WriteFile("/tmp/sync1/a/b/testfile", "hello to you")
+  AssertContents(t, timeout, "/tmp/sync2/testfile", "hello")
+  AssertContents(t, timeout, "/tmp/sync2/a/b/testfile", "hello to you")
+  os.Remove("/tmp/sync1/testfile")
+  os.RemoveAll("/tmp/sync1/a")
+  AssertMissing(t, timeout, "/tmp/sync2/testfile")
+  AssertMissing(t, timeout, "/tmp/sync2/a")
+}
+
 // func TestMerge(t* testing.T) {
 //   test.Cleanup()
 //   setup := test.Start()
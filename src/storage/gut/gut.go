@@ -14,12 +14,16 @@ import (
   // "log"
   "os"
   "path"
+  "path/filepath"
+  "strings"
+  "time"
   "../../serializer"
   "../../types"
 )
 
 type Storage struct {
-  RootPath string
+  RootPath   string
+  Serializer serializer.Serializer
 }
 
 func (s *Storage) getCachePath(hash types.Hash) string {
@@ -65,28 +69,110 @@ func (s *Storage) Get(hash types.Hash) (blob types.Blob, err error) {
   if err != nil {
     return blob, errors.New(fmt.Sprintf("Error (%s) while inflating object: %s", err, cachePath))
   }
-  blob, err = serializer.Configured().Unmarshal(data)
+  blob, err = s.Serializer.Unmarshal(data)
   return blob, err
 }
 
+func (s *Storage) Has(hash types.Hash) bool {
+  _, err := os.Stat(s.getCachePath(hash))
+  return err == nil
+}
+
 func (s *Storage) Put(blob types.Blob) (hash types.Hash, err error) {
-  data, err := serializer.Configured().Marshal(blob)
+  data, err := s.Serializer.Marshal(blob)
+  if err != nil { return nil, err }
   hash = calculateHash(data)
-  compressed := s.Deflate(data)
   cachePath := s.getCachePath(hash)
+  _, err = os.Stat(cachePath)
+  if err == nil {
+    // Objects are immutable, so there's nothing more to write, but garbage
+    // collection goes by when an object was stored and this one is in use
+    // again
+    now := time.Now()
+    return hash, os.Chtimes(cachePath, now, now)
+  }
+  compressed := s.Deflate(data)
   os.MkdirAll(path.Dir(cachePath), 0755)
   // log.Printf("Saving %s to cache (%d bytes)", hex.EncodeToString(hash)[:8], len(data))
-  err = ioutil.WriteFile(cachePath, compressed, 0644)
+  // Several workers may store the same object at once, so write it to a
+  // temporary file and rename it into place.
+  tempFile, err := ioutil.TempFile(path.Dir(cachePath), "tmp_obj_")
+  if err != nil { return hash, err }
+  _, err = tempFile.Write(compressed)
+  closeErr := tempFile.Close()
+  if err == nil { err = closeErr }
+  if err == nil { err = os.Rename(tempFile.Name(), cachePath) }
+  if err != nil { os.Remove(tempFile.Name()) }
   return hash, err
 }
 
+// Refs are written to a temporary file and renamed into place, so that a
+// crash never leaves one empty.
 func (s *Storage) PutRef(name string, hash types.Hash) error {
   refPath := path.Join(s.RootPath, "refs", "heads", name)
-  os.MkdirAll(path.Dir(refPath), 0755)
-  ioutil.WriteFile(refPath, []byte(fmt.Sprintf("%s\n", hex.EncodeToString(hash))), 0644)
-  return nil
+  err := os.MkdirAll(path.Dir(refPath), 0755)
+  if err != nil { return err }
+  tempFile, err := ioutil.TempFile(path.Dir(refPath), "tmp_ref_")
+  if err != nil { return err }
+  _, err = fmt.Fprintf(tempFile, "%s\n", hex.EncodeToString(hash))
+  closeErr := tempFile.Close()
+  if err == nil { err = closeErr }
+  if err == nil { err = os.Rename(tempFile.Name(), refPath) }
+  if err != nil { os.Remove(tempFile.Name()) }
+  return err
 }
 
+// GetRef returns nil (and no error) if there is no such ref yet.
 func (s *Storage) GetRef(name string) (types.Hash, error) {
-  return nil, nil
+  refPath := path.Join(s.RootPath, "refs", "heads", name)
+  data, err := ioutil.ReadFile(refPath)
+  if os.IsNotExist(err) { return nil, nil }
+  if err != nil { return nil, err }
+  return hex.DecodeString(strings.TrimSpace(string(data)))
+}
+
+// ListRefs returns every ref, by name.
+func (s *Storage) ListRefs() (map[string]types.Hash, error) {
+  refs := map[string]types.Hash{}
+  root := path.Join(s.RootPath, "refs", "heads")
+  err := filepath.Walk(root, func(refPath string, info os.FileInfo, err error) error {
+    if err != nil {
+      if os.IsNotExist(err) { return nil }
+      return err
+    }
+    if info.IsDir() || strings.HasPrefix(info.Name(), "tmp_ref_") { return nil }
+    name, err := filepath.Rel(root, refPath)
+    if err != nil { return err }
+    hash, err := s.GetRef(name)
+    if err != nil { return err }
+    refs[name] = hash
+    return nil
+  })
+  return refs, err
+}
+
+// ListObjects calls visit with the hash of every object and when it was
+// stored, stopping at the first error.
+func (s *Storage) ListObjects(visit func(hash types.Hash, stored time.Time) error) error {
+  root := path.Join(s.RootPath, "objects")
+  return filepath.Walk(root, func(objectPath string, info os.FileInfo, err error) error {
+    if err != nil {
+      if os.IsNotExist(err) { return nil }
+      return err
+    }
+    if info.IsDir() || strings.HasPrefix(info.Name(), "tmp_obj_") { return nil }
+    hash, err := hex.DecodeString(path.Base(path.Dir(objectPath)) + info.Name())
+    if err != nil {
+      // Not one of ours
+      return nil
+    }
+    return visit(hash, info.ModTime())
+  })
+}
+
+// Remove deletes an object, whether or not anything still refers to it.
+func (s *Storage) Remove(hash types.Hash) error {
+  err := os.Remove(s.getCachePath(hash))
+  if os.IsNotExist(err) { return nil }
+  return err
 }
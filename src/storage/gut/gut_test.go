@@ -0,0 +1,51 @@
+package gut
+
+import (
+  "bytes"
+  "io/ioutil"
+  "os"
+  "path"
+  "testing"
+  "../../types"
+)
+
+func TestRefs(t *testing.T) {
+  root, err := ioutil.TempDir("", "shared-gut")
+  if err != nil { t.Fatal(err) }
+  defer os.RemoveAll(root)
+  s := &Storage{RootPath: root}
+  hash, err := s.GetRef("master")
+  if hash != nil || err != nil {
+    t.Errorf("Expected no hash and no error for a missing ref, got %x (%v)", hash, err)
+  }
+  refs := map[string]types.Hash{
+    "master": types.Hash{0x12, 0x34},
+    "docs/laptop": types.Hash{0xab, 0xcd},
+  }
+  for name, hash := range refs {
+    err = s.PutRef(name, hash)
+    if err != nil { t.Fatal(err) }
+  }
+  // Replacing a ref leaves only the new hash
+  refs["master"] = types.Hash{0x56, 0x78}
+  err = s.PutRef("master", refs["master"])
+  if err != nil { t.Fatal(err) }
+  // As left behind by a crash mid-write
+  ioutil.WriteFile(path.Join(root, "refs", "heads", "docs", "tmp_ref_123"), []byte("ff\n"), 0644)
+  for name, expected := range refs {
+    hash, err := s.GetRef(name)
+    if err != nil || !bytes.Equal(hash, expected) {
+      t.Errorf("Expected %s to be %x, got %x (%v)", name, expected, hash, err)
+    }
+  }
+  listed, err := s.ListRefs()
+  if err != nil { t.Fatal(err) }
+  if len(listed) != len(refs) {
+    t.Errorf("Expected %d refs, got %v", len(refs), listed)
+  }
+  for name, expected := range refs {
+    if !bytes.Equal(listed[name], expected) {
+      t.Errorf("Expected %s to be listed as %x, got %x", name, expected, listed[name])
+    }
+  }
+}
@@ -2,32 +2,31 @@
 package storage
 
 import (
-  "log"
-  conf "github.com/tillberg/goconfig"
+  "fmt"
+  "time"
+  "../serializer"
   "../types"
   "./gut"
 )
 
 type Storage interface {
   Get(hash types.Hash) (types.Blob, error)
+  Has(hash types.Hash) bool
   Put(blob types.Blob) (types.Hash, error)
   Deflate(in []byte) []byte
   Inflate(in []byte) ([]byte, error)
   PutRef(name string, hash types.Hash) error
   GetRef(name string) (types.Hash, error)
+  ListRefs() (map[string]types.Hash, error)
+  ListObjects(visit func(hash types.Hash, stored time.Time) error) error
+  Remove(hash types.Hash) error
 }
 
-var CacheRoot = ""
-
-func Configured() Storage {
-  config, err := conf.ReadConfigFile("shared.ini")
-  types.Check(err)
-  storage, err := config.GetString("main", "storage")
-  types.Check(err)
-  if storage == "gut" {
-    return Storage(&gut.Storage{RootPath: CacheRoot})
-  } else {
-    log.Fatalf("Unrecognized storage configured: %s", storage)
+// New returns the storage of the given kind (only gut, for now), keeping
+// its objects and refs beneath rootPath.
+func New(kind string, rootPath string, serializer serializer.Serializer) (Storage, error) {
+  if kind == "gut" {
+    return Storage(&gut.Storage{RootPath: rootPath, Serializer: serializer}), nil
   }
-  return nil
+  return nil, fmt.Errorf("Unrecognized storage configured: %s", kind)
 }
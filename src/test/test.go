@@ -8,6 +8,7 @@ import (
   "fmt"
   "io"
   "bufio"
+  conf "github.com/tillberg/goconfig"
   "../network"
   "../sharedpb"
 )
@@ -87,9 +88,13 @@ func StartB(setup *TestSetup) {
 }
 
 func ConnectBA() {
+  config, err := conf.ReadConfigFile("shared.ini")
+  check(err)
+  apikey, err := config.GetString("main", "apikey")
+  check(err)
   address := "localhost:9251"
   message := &sharedpb.Message{AddRemote: []string{address}}
-  network.SendSingleMessage(message, "localhost:9252")
+  network.SendSingleMessage(message, "localhost:9252", apikey)
 }
 
 func Start() *TestSetup {
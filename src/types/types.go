@@ -3,6 +3,8 @@ package types
 
 import (
   "log"
+  "strings"
+  "sync"
   "../sharedpb"
 )
 
@@ -14,15 +16,42 @@ func Check(err interface{}) {
 
 type BlobRequest struct {
   Hash            Hash
-  ResponseChannel chan Hash
+  ResponseChannel chan BlobResponse
 }
 
+// Found is false once every peer asked has said it doesn't have the object.
+type BlobResponse struct {
+  Hash  Hash
+  Found bool
+}
+
+// A peer saying that it doesn't have an object we asked it for
+type BlobDecline struct {
+  Hash     Hash
+  Servicer chan *sharedpb.Message
+}
+
+// Branch names are only unique within a share.  With Prefix set, Name
+// matches every branch in the share whose name begins with it, e.g.
+// "origin/".  Sent on BranchUnsubscribeChannel, a subscription cancels the
+// one with the same fields.
 type BranchSubscription struct {
+  Share           string
   Name            string
+  Prefix          bool
   ResponseChannel chan BranchStatus
 }
 
+func (subscription BranchSubscription) Matches(status BranchStatus) bool {
+  if status.Share != subscription.Share { return false }
+  if subscription.Prefix {
+    return strings.HasPrefix(status.Name, subscription.Name)
+  }
+  return status.Name == subscription.Name
+}
+
 type BranchStatus struct {
+  Share  string
   Name   string
   Hash   Hash
 }
@@ -33,12 +62,107 @@ type BranchAncestryQuery struct {
   ResponseChannel chan bool
 }
 
-var BlobRequestChannel     = make(chan BlobRequest, 100)
-var BranchSubscribeChannel = make(chan BranchSubscription, 100)
-var BranchUpdateChannel    = make(chan BranchStatus, 100)
-var BlobReceiveChannel     = make(chan Blob, 100)
-var BlobServicerChannel    = make(chan chan *sharedpb.Message, 100)
-var DoesADescendFromBChannel = make(chan BranchAncestryQuery, 100)
+// Finds the best common ancestor of two commits; Base is nil if there is none
+type MergeBaseQuery struct {
+  CommitA Hash
+  CommitB Hash
+  ResponseChannel chan MergeBaseResponse
+}
+
+type MergeBaseResponse struct {
+  Base Hash
+  Err  error
+}
+
+// Counts the commits each side has that the other doesn't
+type AheadBehindQuery struct {
+  Local  Hash
+  Remote Hash
+  ResponseChannel chan AheadBehindResponse
+}
+
+type AheadBehindResponse struct {
+  Ahead  int
+  Behind int
+  Err    error
+}
+
+// Lists the commits reachable from CommitB but not CommitA, newest first
+type CommitsBetweenQuery struct {
+  CommitA Hash
+  CommitB Hash
+  ResponseChannel chan CommitsBetweenResponse
+}
+
+type CommitsBetweenResponse struct {
+  Commits []Hash
+  Err     error
+}
+
+// Raised when a merge finds a file changed differently on two peers.  The
+// winning version stays at Path and the other is written to CopyPath.
+type Conflict struct {
+  Path     string
+  CopyPath string
+  Peer     string
+  Commit   Hash
+}
+
+// A Hub carries everything that passes between one node's arbiters,
+// branches and connections.  Closing Done stops them all, and Wait waits
+// for every goroutine started with Go to finish.
+type Hub struct {
+  BlobRequestChannel       chan BlobRequest
+  BranchSubscribeChannel   chan BranchSubscription
+  BranchUnsubscribeChannel chan BranchSubscription
+  BranchUpdateChannel      chan BranchStatus
+  BlobReceiveChannel       chan Blob
+  BlobServicerChannel      chan chan *sharedpb.Message
+  // Servicers whose connection has closed.  Unbuffered, so that once it's
+  // taken, nothing more will be sent to the servicer.
+  BlobServicerGoneChannel  chan chan *sharedpb.Message
+  BlobDeclineChannel       chan BlobDecline
+  DoesADescendFromBChannel chan BranchAncestryQuery
+  MergeBaseChannel         chan MergeBaseQuery
+  AheadBehindChannel       chan AheadBehindQuery
+  CommitsBetweenChannel    chan CommitsBetweenQuery
+  // Conflicts are dropped if nobody is keeping up with this channel
+  ConflictChannel          chan Conflict
+  Done                     chan struct{}
+  running                  sync.WaitGroup
+}
+
+// Go runs f in a new goroutine, which must return once Done is closed.
+func (hub *Hub) Go(f func()) {
+  hub.running.Add(1)
+  go func() {
+    defer hub.running.Done()
+    f()
+  }()
+}
+
+func (hub *Hub) Wait() {
+  hub.running.Wait()
+}
+
+func NewHub() *Hub {
+  return &Hub{
+    BlobRequestChannel: make(chan BlobRequest, 100),
+    BranchSubscribeChannel: make(chan BranchSubscription, 100),
+    BranchUnsubscribeChannel: make(chan BranchSubscription, 100),
+    BranchUpdateChannel: make(chan BranchStatus, 100),
+    BlobReceiveChannel: make(chan Blob, 100),
+    BlobServicerChannel: make(chan chan *sharedpb.Message, 100),
+    BlobServicerGoneChannel: make(chan chan *sharedpb.Message),
+    BlobDeclineChannel: make(chan BlobDecline, 100),
+    DoesADescendFromBChannel: make(chan BranchAncestryQuery, 100),
+    MergeBaseChannel: make(chan MergeBaseQuery, 100),
+    AheadBehindChannel: make(chan AheadBehindQuery, 100),
+    CommitsBetweenChannel: make(chan CommitsBetweenQuery, 100),
+    ConflictChannel: make(chan Conflict, 100),
+    Done: make(chan struct{}),
+  }
+}
 
 type Hash []byte
 
@@ -0,0 +1,30 @@
+package types
+
+import (
+  "testing"
+)
+
+func TestBranchSubscriptionMatches(t *testing.T) {
+  exact := BranchSubscription{Share: "docs", Name: "origin/master"}
+  prefix := BranchSubscription{Share: "docs", Name: "origin/", Prefix: true}
+  cases := []struct {
+    status         BranchStatus
+    exact, prefix  bool
+  }{
+    {BranchStatus{Share: "docs", Name: "origin/master"}, true, true},
+    {BranchStatus{Share: "docs", Name: "origin/laptop"}, false, true},
+    {BranchStatus{Share: "docs", Name: "origin/master-old"}, false, true},
+    {BranchStatus{Share: "docs", Name: "master"}, false, false},
+    // Branches are only unique within a share
+    {BranchStatus{Share: "music", Name: "origin/master"}, false, false},
+    {BranchStatus{Share: "", Name: "origin/master"}, false, false},
+  }
+  for _, c := range cases {
+    if exact.Matches(c.status) != c.exact {
+      t.Errorf("Expected %s/%s to match %s exactly: %v", c.status.Share, c.status.Name, exact.Name, c.exact)
+    }
+    if prefix.Matches(c.status) != c.prefix {
+      t.Errorf("Expected %s/%s to match prefix %s: %v", c.status.Share, c.status.Name, prefix.Name, c.prefix)
+    }
+  }
+}